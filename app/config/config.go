@@ -6,12 +6,23 @@ import (
 )
 
 type AppConfig struct {
-	Mqtt        *homeassistant.MqttConfig `json:"mqtt"`
-	Gpiod       *Gpiod                    `json:"gpiod"`
-	HADevice    *model.Device             `json:"home_assistant_device"`
-	Pumps       []*PumpConfig             `json:"pumps"`
-	TempSensors []*TempSensorsConfig      `json:"temperature_sensors,omitempty"`
-	Buttons     []*ButtonConfig           `json:"buttons,omitempty"`
+	Mqtt         *homeassistant.MqttConfig `json:"mqtt"`
+	Gpiod        *Gpiod                    `json:"gpiod"`
+	HADevice     *model.Device             `json:"home_assistant_device"`
+	Pumps        []*PumpConfig             `json:"pumps"`
+	TempSensors  []*TempSensorsConfig      `json:"temperature_sensors,omitempty"`
+	TempSampling *TempSamplingConfig       `json:"temperature_sampling,omitempty"`
+	DS18B20      *DS18B20Config            `json:"ds18b20,omitempty"`
+	AutoRegister bool                      `json:"auto_register_sensors,omitempty"` // register unconfigured 1-Wire sensors with a placeholder name
+	Buttons      []*ButtonConfig           `json:"buttons,omitempty"`
+	Bindings     []*ButtonBindingConfig    `json:"button_bindings,omitempty"`
+	LocalCtl     *LocalControlConfig       `json:"local_control,omitempty"`
+	PumpStats    string                    `json:"pump_stats_file,omitempty"`
+	Interlocks   []*InterlockConfig        `json:"overheat_interlocks,omitempty"`
+	Frost        []*FrostConfig            `json:"frost_protection,omitempty"`
+	BufferTank   *BufferTankConfig         `json:"buffer_tank,omitempty"`
+	HeatFlows    []*HeatFlowConfig         `json:"heat_flow_sensors,omitempty"`
+	Trends       []*TrendConfig            `json:"trend_sensors,omitempty"`
 }
 
 type Gpiod struct {
@@ -20,19 +31,231 @@ type Gpiod struct {
 }
 
 type PumpConfig struct {
-	ID           int    `json:"id"`
-	Name         string `json:"name"`
-	GpioStatePin int    `json:"gpio_state_pin"`
+	ID                 int               `json:"id"`
+	Name               string            `json:"name"`
+	GpioStatePin       int               `json:"gpio_state_pin"`
+	MinOnSeconds       int               `json:"min_on_seconds,omitempty"`        // minimum time the pump stays ON before it may be switched OFF
+	MinOffSeconds      int               `json:"min_off_seconds,omitempty"`       // minimum time the pump stays OFF before it may be switched ON
+	MaxSwitchesPerHour int               `json:"max_switches_per_hour,omitempty"` // switches beyond this limit are rejected, 0 means unlimited
+	RatedWatts         float64           `json:"rated_watts,omitempty"`           // rated power of the pump, used for energy accounting
+	Thermostat         *ThermostatConfig `json:"local_thermostat,omitempty"`
+	OverrideMinutes    int               `json:"override_minutes,omitempty"` // default duration of manual overrides, default 60
 }
 
+// ThermostatConfig links a pump to a temperature sensor for local control
+// By default the pump turns ON below Setpoint-Hysteresis and OFF at Setpoint,
+// with OnAbove the pump turns ON above Setpoint+Hysteresis and OFF at Setpoint
+type ThermostatConfig struct {
+	SensorID   string  `json:"sensor_id"`
+	Setpoint   float64 `json:"setpoint"`
+	Hysteresis float64 `json:"hysteresis"`
+	OnAbove    bool    `json:"on_above,omitempty"`
+}
+
+// LocalControlConfig configures when local thermostats take over from Home Assistant
+type LocalControlConfig struct {
+	HATimeout int `json:"ha_timeout"`         // seconds without Home Assistant commands before local control takes over
+	Interval  int `json:"interval,omitempty"` // seconds between local thermostat evaluations
+}
+
+// InterlockConfig forces pumps ON while a sensor is above MaxTemp
+// The interlock is released once the temperature drops below MaxTemp-Hysteresis
+type InterlockConfig struct {
+	ID         int     `json:"id"`
+	Name       string  `json:"name"`
+	SensorID   string  `json:"sensor_id"`
+	MaxTemp    float64 `json:"max_temp"`
+	Hysteresis float64 `json:"hysteresis"`
+	PumpIDs    []int   `json:"pump_ids"`
+}
+
+// FrostConfig forces pumps ON while any of the sensors is below FrostTemp
+// Frost protection is released once all sensors are above FrostTemp+Hysteresis
+type FrostConfig struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	SensorIDs  []string `json:"sensor_ids"`
+	FrostTemp  float64  `json:"frost_temp"`
+	Hysteresis float64  `json:"hysteresis"`
+	PumpIDs    []int    `json:"pump_ids"`
+}
+
+// BufferTankConfig describes a stratified buffer tank for stored energy calculation
+// EmptyTemp is the temperature considered as no usable energy, FullTemp as fully charged tank
+type BufferTankConfig struct {
+	Name         string               `json:"name"`
+	VolumeLiters float64              `json:"volume_liters"`
+	EmptyTemp    float64              `json:"empty_temp"`
+	FullTemp     float64              `json:"full_temp"`
+	Layers       []*BufferLayerConfig `json:"layers"`
+}
+
+// BufferLayerConfig maps a horizontal tank layer to the sensor measuring it
+// VolumeShare is the fraction of the tank volume in this layer, layers without it split the rest equally
+type BufferLayerConfig struct {
+	SensorID    string  `json:"sensor_id"`
+	VolumeShare float64 `json:"volume_share,omitempty"`
+}
+
+// HeatFlowConfig describes a virtual sensor calculated from an inlet/outlet sensor pair
+// The temperature difference is always published, the thermal power only with a flow rate configured.
+// With a linked pump the thermal power is zero while the pump is OFF.
+type HeatFlowConfig struct {
+	ID                  int     `json:"id"`
+	Name                string  `json:"name"`
+	InletSensorID       string  `json:"inlet_sensor_id"`
+	OutletSensorID      string  `json:"outlet_sensor_id"`
+	FlowLitersPerMinute float64 `json:"flow_lpm,omitempty"`
+	PumpID              int     `json:"pump_id,omitempty"`
+}
+
+// TrendConfig describes a rate of change sensor calculated from the sampling history of a sensor
+type TrendConfig struct {
+	ID       int                  `json:"id"`
+	Name     string               `json:"name"`
+	SensorID string               `json:"sensor_id"`
+	Window   int                  `json:"window,omitempty"` // seconds of history the rate is calculated from, default 300
+	Activity *TrendActivityConfig `json:"activity,omitempty"`
+}
+
+// TrendActivityConfig describes a binary sensor driven by the rate of change, e.g. "Oven Fire Active"
+// It turns ON once the rate rises to RiseRate and OFF once it falls to FallRate or the temperature drops below MinTemp
+type TrendActivityConfig struct {
+	Name     string   `json:"name"`
+	RiseRate float64  `json:"rise_rate"`          // °C per minute
+	FallRate float64  `json:"fall_rate"`          // °C per minute, lower than RiseRate
+	MinTemp  *float64 `json:"min_temp,omitempty"` // the activity is OFF below this temperature
+}
+
+// TempSamplingConfig holds settings shared by all temperature sensors
+type TempSamplingConfig struct {
+	MaxFailedReads int `json:"max_failed_reads,omitempty"` // failed reads in a row before a sensor is reported unavailable
+	ExpireAfter    int `json:"expire_after,omitempty"`     // seconds after which Home Assistant expires a value that was not updated
+	ReadTimeoutMs  int `json:"read_timeout_ms,omitempty"`  // a single sensor read is given up after this time, default 5000 ms
+	SensorSampling
+}
+
+// SensorSampling holds sampling settings, set globally in TempSamplingConfig and overridable per sensor
+type SensorSampling struct {
+	PollInterval int      `json:"poll_interval,omitempty"` // seconds between two reads of a sensor, default 30
+	MinDelta     *float64 `json:"min_delta,omitempty"`     // smallest change in °C that is published, default 0 publishes every read
+	MaxSilence   int      `json:"max_silence,omitempty"`   // seconds after which an unchanged value is published again, default 60
+}
+
+// DS18B20Config holds the read settings of DS18B20 sensors
+// Resolution, conversion time and bulk read need a kernel whose w1_therm driver exposes them in sysfs
+type DS18B20Config struct {
+	CRCRetries   *int `json:"crc_retries,omitempty"`    // additional reads after a failed one, default 2
+	RetryDelayMs int  `json:"retry_delay_ms,omitempty"` // pause between retried reads, default 100 ms
+	Resolution   int  `json:"resolution,omitempty"`     // 9-12 bit, default keeps the sensor setting
+	ConvTimeMs   int  `json:"conv_time_ms,omitempty"`   // conversion time the driver waits for, default keeps the driver setting
+	BulkRead     bool `json:"bulk_read,omitempty"`      // convert all sensors at once on the bus master before reading
+}
+
+// Temperature sensor driver types
+const (
+	SensorTypeDS18B20    = "ds18b20"
+	SensorTypeMAX31865   = "max31865"
+	SensorTypeThermistor = "ads1115_thermistor"
+	SensorTypeBME280     = "bme280"
+)
+
 type TempSensorsConfig struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Type       string   `json:"type,omitempty"`       // driver of the sensor, default "ds18b20"
+	Device     string   `json:"device,omitempty"`     // spidev or i2c-dev device file, not used by ds18b20
+	Resolution int      `json:"resolution,omitempty"` // DS18B20 resolution of the sensor in bits, overrides ds18b20.resolution
+	MinTemp    *float64 `json:"min_temp,omitempty"`   // lowest plausible value, readings below are rejected
+	MaxTemp    *float64 `json:"max_temp,omitempty"`   // highest plausible value, readings above are rejected
+	Offset     float64  `json:"offset,omitempty"`     // added to the reading after scaling
+	Scale      float64  `json:"scale,omitempty"`      // multiplies the reading, 0 means no scaling
+	SensorSampling
+	Filters    []*FilterConfig   `json:"filters,omitempty"`     // applied in order to every successful reading
+	PublishRaw bool              `json:"publish_raw,omitempty"` // publish the unfiltered reading as a diagnostic sensor
+	MAX31865   *MAX31865Config   `json:"max31865,omitempty"`
+	Thermistor *ThermistorConfig `json:"thermistor,omitempty"`
+	BME280     *BME280Config     `json:"bme280,omitempty"`
+}
+
+// DriverType returns the driver type of the sensor
+func (c *TempSensorsConfig) DriverType() string {
+	if c.Type == "" {
+		return SensorTypeDS18B20
+	}
+	return c.Type
+}
+
+// MAX31865Config describes a PT100/PT1000 RTD read by a MAX31865 converter
+type MAX31865Config struct {
+	RNominal   float64 `json:"r_nominal,omitempty"`   // RTD resistance at 0 °C, default 100 (PT100)
+	RRef       float64 `json:"r_ref,omitempty"`       // reference resistor on the board, default 430
+	Wires      int     `json:"wires,omitempty"`       // 2, 3 or 4 wire RTD, default 2
+	SpeedHz    uint32  `json:"speed_hz,omitempty"`    // SPI clock, default 500 kHz
+	Filter50Hz bool    `json:"filter_50hz,omitempty"` // reject 50 Hz mains noise instead of 60 Hz
+}
+
+// ThermistorConfig describes an NTC thermistor in a voltage divider read by an ADS1115 ADC
+// The thermistor is connected between the ADC input and ground, the series resistor between the input and supply
+type ThermistorConfig struct {
+	Address           uint16  `json:"address,omitempty"`            // I2C address of the ADS1115, default 0x48
+	Channel           int     `json:"channel"`                      // single-ended input AIN0-AIN3
+	SupplyVoltage     float64 `json:"supply_voltage,omitempty"`     // divider supply, default 3.3 V
+	SeriesResistor    float64 `json:"series_resistor,omitempty"`    // default 10 kΩ
+	NominalResistance float64 `json:"nominal_resistance,omitempty"` // thermistor resistance at NominalTemp, default 10 kΩ
+	NominalTemp       float64 `json:"nominal_temp,omitempty"`       // default 25 °C
+	Beta              float64 `json:"beta,omitempty"`               // B coefficient, default 3950
 }
 
+// BME280Config describes a BME280 temperature, humidity and pressure sensor
+type BME280Config struct {
+	Address         uint16 `json:"address,omitempty"`          // I2C address, default 0x76
+	PublishHumidity bool   `json:"publish_humidity,omitempty"` // publish relative humidity as a Home Assistant sensor
+}
+
+// FilterConfig configures a single step of a sensor filter pipeline
+// Type is one of "median" (Window), "ema" (Alpha) or "rate_limit" (MaxRate)
+type FilterConfig struct {
+	Type    string  `json:"type"`
+	Window  int     `json:"window,omitempty"`   // number of readings the median is taken from
+	Alpha   float64 `json:"alpha,omitempty"`    // weight of the newest reading, 0 < alpha <= 1
+	MaxRate float64 `json:"max_rate,omitempty"` // largest accepted change in °C per minute
+}
+
+// Button line biases
+const (
+	BiasPullUp   = "pull_up"
+	BiasPullDown = "pull_down"
+	BiasDisabled = "disabled"
+)
+
 type ButtonConfig struct {
-	ID           int    `json:"id"`
-	Name         string `json:"name"`
-	GpioInputPin int    `json:"gpio_input_pin"`
-	EnablePullUp bool   `json:"enable_pull_up"`
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	GpioInputPin  int    `json:"gpio_input_pin"`
+	EnablePullUp  bool   `json:"enable_pull_up,omitempty"`  // deprecated, same as bias pull_up
+	ActiveLow     *bool  `json:"active_low,omitempty"`      // the button is pressed while the line is low, default true
+	Bias          string `json:"bias,omitempty"`            // pull_up, pull_down or disabled, left as is if not set
+	DebounceMs    *int   `json:"debounce_ms,omitempty"`     // default 20 ms, 0 disables debouncing
+	LongPressMs   int    `json:"long_press_ms,omitempty"`   // presses at least this long are long presses, default 800 ms
+	DoubleClickMs *int   `json:"double_click_ms,omitempty"` // longest pause between the clicks of a double click, default 400 ms, 0 disables double clicks
+	HoldRepeatMs  int    `json:"hold_repeat_ms,omitempty"`  // hold events repeat at this interval while the button stays pressed, default 500 ms
+}
+
+// Button binding actions
+const (
+	BindingToggle         = "toggle"          // BindingToggle overrides the pump to the opposite state.
+	BindingForceOn        = "force_on"        // BindingForceOn overrides the pump ON.
+	BindingForceOff       = "force_off"       // BindingForceOff overrides the pump OFF.
+	BindingCancelOverride = "cancel_override" // BindingCancelOverride hands the pump back to automatic control.
+)
+
+// ButtonBindingConfig maps a gesture of a button to a pump action, so pumps can be switched at the boiler
+// Every switching action is a manual override, automatic control takes over again once it elapses
+type ButtonBindingConfig struct {
+	ButtonID int    `json:"button_id"`
+	Gesture  string `json:"gesture"` // short_press, long_press, double_press or hold
+	PumpID   int    `json:"pump_id"`
+	Action   string `json:"action"`            // toggle, force_on, force_off or cancel_override
+	Minutes  int    `json:"minutes,omitempty"` // override duration, default is the override_minutes of the pump
 }
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"fmt"
+	"rpi-heating-system/app/config"
+	"rpi-heating-system/app/services"
+	"rpi-heating-system/lib/homeassistant/model"
+	"strconv"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// HABufferTankHandler is the implementation of HAController interface
+// It publishes the stored energy and charge level of the buffer tank as Home Assistant sensors
+type HABufferTankHandler struct {
+	client    MQTT.Client
+	tankSvc   *services.BufferTankService
+	haDevice  *model.Device
+	energyCfg *model.Sensor
+	chargeCfg *model.Sensor
+	ticker    *time.Ticker
+
+	deviceAvailabilityTopic string
+}
+
+// NewHABufferTankHandler creates a new instance of HABufferTankHandler
+func NewHABufferTankHandler(
+	mqttClient MQTT.Client,
+	conf *config.AppConfig,
+	tankSvc *services.BufferTankService,
+) (*HABufferTankHandler, error) {
+
+	h := &HABufferTankHandler{
+		client:   mqttClient,
+		tankSvc:  tankSvc,
+		haDevice: conf.HADevice,
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
+	}
+
+	// build configs
+	h.energyCfg = h.getSensorConfig("buffer_tank_energy", conf.BufferTank.Name+" Stored Energy")
+	h.energyCfg.DeviceClass = "energy_storage"
+	h.energyCfg.UnitOfMeasurement = "kWh"
+	h.energyCfg.StateClass = model.StateClassMeasurement
+	h.chargeCfg = h.getSensorConfig("buffer_tank_charge", conf.BufferTank.Name+" Charge")
+	h.chargeCfg.UnitOfMeasurement = "%"
+	h.chargeCfg.StateClass = model.StateClassMeasurement
+	h.chargeCfg.Icon = "mdi:storage-tank"
+
+	err := h.Announce()
+	if err != nil {
+		return nil, err
+	}
+
+	h.ticker = time.NewTicker(time.Minute)
+	go func() {
+		for range h.ticker.C {
+			err := h.reportTankState()
+			if err != nil {
+				log.Error().Msgf("failed to report buffer tank state: %s", err)
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// Announce sends buffer tank sensor configs, availability and the current state to Home Assistant
+func (obj *HABufferTankHandler) Announce() error {
+	for _, sensor := range []*model.Sensor{obj.energyCfg, obj.chargeCfg} {
+		err := obj.sendConfig(sensor)
+		if err != nil {
+			return fmt.Errorf("failed to send config for sensor %s, err: %w", sensor.UniqueID, err)
+		}
+		// Home Assistant is slow sometimes while processing new configs... wait a bit
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, sensor := range []*model.Sensor{obj.energyCfg, obj.chargeCfg} {
+		token := obj.client.Publish(obj.availabilityTopic(sensor.UniqueID), 0, true, "online")
+		if !token.WaitTimeout(2 * time.Second) {
+			return fmt.Errorf("failed to update sensor %s availability, %w", sensor.UniqueID, token.Error())
+		}
+	}
+
+	// a failing layer sensor must not prevent the announcement, the ticker reports the state later
+	err := obj.reportTankState()
+	if err != nil {
+		log.Error().Msgf("failed to report buffer tank state: %s", err)
+	}
+	return nil
+}
+
+// Close closes the HABufferTankHandler and performs necessary cleanup
+func (obj *HABufferTankHandler) Close() error {
+	obj.ticker.Stop()
+	return nil
+}
+
+// reportTankState calculates the buffer tank state and reports it to Home Assistant
+func (obj *HABufferTankHandler) reportTankState() error {
+	state, err := obj.tankSvc.Calculate()
+	if err != nil {
+		return err
+	}
+	log.Debug().Msgf("Reporting buffer tank energy %.2f kWh, charge %.1f %%", state.EnergyKWh, state.ChargePercent)
+	err = obj.sendFeedbackMessage(strconv.FormatFloat(state.EnergyKWh, 'f', 2, 64), obj.energyCfg.StateTopic)
+	if err != nil {
+		return err
+	}
+	return obj.sendFeedbackMessage(strconv.FormatFloat(state.ChargePercent, 'f', 1, 64), obj.chargeCfg.StateTopic)
+}
+
+// getSensorConfig creates a base configuration for a buffer tank sensor
+func (obj *HABufferTankHandler) getSensorConfig(uid string, name string) *model.Sensor {
+	return &model.Sensor{
+		Schema:     "json",
+		UniqueID:   uid,
+		Name:       name,
+		Device:     obj.haDevice,
+		StateTopic: fmt.Sprintf("homeassistant/sensor/%s/state", uid),
+		Availability: []*model.Availability{
+			{Topic: obj.availabilityTopic(uid)},
+			{Topic: obj.deviceAvailabilityTopic},
+		},
+		AvailabilityMode: model.AvailabilityModeAll,
+	}
+}
+
+// availabilityTopic returns the availability topic of a single sensor
+func (obj *HABufferTankHandler) availabilityTopic(uid string) string {
+	return fmt.Sprintf("homeassistant/sensor/%s/status", uid)
+}
+
+// sendFeedbackMessage sends feedback message to Home Assistant.
+func (obj *HABufferTankHandler) sendFeedbackMessage(msg string, stateTopic string) error {
+	token := obj.client.Publish(stateTopic, 0, true, msg)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("failed to send feedback message to topic %s: %w", stateTopic, token.Error())
+	}
+	return nil
+}
+
+// sendConfig sends configuration to Home Assistant for a sensor
+func (obj *HABufferTankHandler) sendConfig(sensor *model.Sensor) error {
+	conf, err := jsoniter.MarshalToString(sensor)
+	if err != nil {
+		return err
+	}
+	token := obj.client.Publish(fmt.Sprintf("homeassistant/sensor/%s/config", sensor.UniqueID), 0, true, conf)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("failed to send config %v: %w", sensor, token.Error())
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"fmt"
+	"rpi-heating-system/app/config"
+	"rpi-heating-system/app/services"
+	"rpi-heating-system/lib/homeassistant/model"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// gestureTriggerTypes maps the gestures to the device trigger types known by Home Assistant
+var gestureTriggerTypes = map[services.ButtonGesture]string{
+	services.GestureShortPress:  "button_short_press",
+	services.GestureLongPress:   "button_long_press",
+	services.GestureDoublePress: "button_double_press",
+	services.GestureHold:        "button_hold",
+}
+
+// buttonGestureEntities holds the Home Assistant configs of a single button's gestures
+type buttonGestureEntities struct {
+	triggers []*model.DeviceTrigger
+	event    *model.Event
+}
+
+// HAButtonGesturesHandler is the implementation of HAController interface
+// It publishes button gestures as Home Assistant device triggers and event entities
+type HAButtonGesturesHandler struct {
+	client      MQTT.Client
+	haDevice    *model.Device
+	gestureCfgs map[int]*buttonGestureEntities // keyed by button ID
+
+	deviceAvailabilityTopic string
+}
+
+// NewHAButtonGesturesHandler creates a new instance of HAButtonGesturesHandler
+func NewHAButtonGesturesHandler(
+	mqttClient MQTT.Client,
+	conf *config.AppConfig,
+	gestureSvc *services.GestureService,
+) (*HAButtonGesturesHandler, error) {
+
+	h := &HAButtonGesturesHandler{
+		client:      mqttClient,
+		haDevice:    conf.HADevice,
+		gestureCfgs: make(map[int]*buttonGestureEntities),
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
+	}
+
+	// build configs before the first gesture arrives
+	for _, button := range conf.Buttons {
+		h.gestureCfgs[button.ID] = h.getGestureConfig(button)
+	}
+
+	err := h.Announce()
+	if err != nil {
+		return nil, err
+	}
+
+	gestureSvc.AddObserver(h.onGesture)
+	return h, nil
+}
+
+// Announce sends device trigger and event entity configs and availability to Home Assistant
+func (obj *HAButtonGesturesHandler) Announce() error {
+	for _, button := range obj.gestureCfgs {
+		for _, trigger := range button.triggers {
+			uid := fmt.Sprintf("%s_%s", trigger.Subtype, trigger.Payload)
+			err := obj.sendConfig("device_automation", uid, trigger)
+			if err != nil {
+				return fmt.Errorf("failed to send config for trigger %s, err: %w", uid, err)
+			}
+		}
+		err := obj.sendConfig("event", button.event.UniqueID, button.event)
+		if err != nil {
+			return fmt.Errorf("failed to send config for event %s, err: %w", button.event.UniqueID, err)
+		}
+		// Home Assistant is slow sometimes while processing new configs... wait a bit
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, button := range obj.gestureCfgs {
+		token := obj.client.Publish(obj.availabilityTopic(button.event.UniqueID), 0, true, "online")
+		if !token.WaitTimeout(2 * time.Second) {
+			return fmt.Errorf("failed to update event %s availability, %w", button.event.UniqueID, token.Error())
+		}
+	}
+	return nil
+}
+
+// Close closes the HAButtonGesturesHandler and performs necessary cleanup
+func (obj *HAButtonGesturesHandler) Close() error {
+	return nil
+}
+
+// onGesture fires the device trigger and the event entity of the gesture
+func (obj *HAButtonGesturesHandler) onGesture(button *config.ButtonConfig, gesture services.ButtonGesture) {
+	cfg, ok := obj.gestureCfgs[button.ID]
+	if !ok {
+		log.Error().Msgf("Button %d not found in config", button.ID)
+		return
+	}
+	// gestures are not retained, Home Assistant must not replay them after a restart
+	err := obj.sendGesture(string(gesture), cfg.triggers[0].Topic)
+	if err != nil {
+		log.Error().Msgf("failed to send button %s trigger: %s", button.Name, err)
+	}
+	msg, err := jsoniter.MarshalToString(&model.EventMessage{EventType: string(gesture)})
+	if err != nil {
+		log.Error().Msgf("failed to marshal button %s event: %s", button.Name, err)
+		return
+	}
+	err = obj.sendGesture(msg, cfg.event.StateTopic)
+	if err != nil {
+		log.Error().Msgf("failed to send button %s event: %s", button.Name, err)
+	}
+}
+
+// getGestureConfig creates the device triggers and the event entity of a button
+func (obj *HAButtonGesturesHandler) getGestureConfig(button *config.ButtonConfig) *buttonGestureEntities {
+	uid := fmt.Sprintf("button_%d", button.ID)
+	entities := &buttonGestureEntities{}
+	eventTypes := make([]string, 0, len(services.ButtonGestures))
+	for _, gesture := range services.ButtonGestures {
+		entities.triggers = append(entities.triggers, &model.DeviceTrigger{
+			AutomationType: "trigger",
+			Topic:          fmt.Sprintf("homeassistant/device_automation/%s/action", uid),
+			Type:           gestureTriggerTypes[gesture],
+			Subtype:        uid,
+			Payload:        string(gesture),
+			Device:         obj.haDevice,
+		})
+		eventTypes = append(eventTypes, string(gesture))
+	}
+
+	eventUID := uid + "_gesture"
+	entities.event = &model.Event{
+		UniqueID:   eventUID,
+		Name:       button.Name + " Gesture",
+		Device:     obj.haDevice,
+		StateTopic: fmt.Sprintf("homeassistant/event/%s/state", eventUID),
+		Availability: []*model.Availability{
+			{Topic: obj.availabilityTopic(eventUID)},
+			{Topic: obj.deviceAvailabilityTopic},
+		},
+		AvailabilityMode: model.AvailabilityModeAll,
+		EventTypes:       eventTypes,
+		DeviceClass:      "button",
+	}
+	return entities
+}
+
+// availabilityTopic returns the availability topic of a single event entity
+func (obj *HAButtonGesturesHandler) availabilityTopic(uid string) string {
+	return fmt.Sprintf("homeassistant/event/%s/status", uid)
+}
+
+// sendGesture sends a gesture message without retaining it
+func (obj *HAButtonGesturesHandler) sendGesture(msg string, topic string) error {
+	token := obj.client.Publish(topic, 0, false, msg)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("failed to send gesture message to topic %s: %w", topic, token.Error())
+	}
+	return nil
+}
+
+// sendConfig sends configuration to Home Assistant for an entity of the component
+func (obj *HAButtonGesturesHandler) sendConfig(component string, uid string, entity any) error {
+	conf, err := jsoniter.MarshalToString(entity)
+	if err != nil {
+		return err
+	}
+	token := obj.client.Publish(fmt.Sprintf("homeassistant/%s/%s/config", component, uid), 0, true, conf)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("failed to send config %v: %w", entity, token.Error())
+	}
+	return nil
+}
@@ -5,12 +5,13 @@ import (
 	"rpi-heating-system/app/config"
 	"rpi-heating-system/app/services"
 	"rpi-heating-system/lib/homeassistant/model"
+	"strconv"
+	"sync"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/rs/zerolog/log"
-	"github.com/warthog618/gpiod"
 )
 
 // HAButtonsHandler is the implementation of HAController interface
@@ -20,6 +21,13 @@ type HAButtonsHandler struct {
 	haDevice         *model.Device
 	buttonsCfgs      map[int]*model.BinarySensor
 	svcSubscriptions []*services.BtnPressSubscription
+	mu               sync.Mutex
+	buttonStates     map[int]string // last reported state, keyed by GPIO pin
+	droppedCfg       *model.Sensor
+	lastDropped      uint64 // last reported number of dropped events
+	ticker           *time.Ticker
+
+	deviceAvailabilityTopic string
 }
 
 // NewHAButtonsHandler creates a new instance of HAButtonsHandler
@@ -30,12 +38,22 @@ func NewHAButtonsHandler(
 ) (*HAButtonsHandler, error) {
 
 	h := &HAButtonsHandler{
-		client:      mqttClient,
-		buttonSvc:   buttonSvc,
-		haDevice:    conf.HADevice,
-		buttonsCfgs: make(map[int]*model.BinarySensor),
+		client:       mqttClient,
+		buttonSvc:    buttonSvc,
+		haDevice:     conf.HADevice,
+		buttonsCfgs:  make(map[int]*model.BinarySensor),
+		buttonStates: make(map[int]string),
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
 	}
 
+	// build configs before the first event arrives
+	for _, button := range conf.Buttons {
+		buttonConf := h.getButtonConfig(button)
+		h.buttonsCfgs[button.GpioInputPin] = buttonConf
+	}
+	h.droppedCfg = h.getDroppedConfig()
+
 	for _, button := range conf.Buttons {
 		subs, err := buttonSvc.SubscribeOnButtonPress(button.GpioInputPin, fmt.Sprintf("%d", button.ID))
 		if err != nil {
@@ -52,7 +70,7 @@ func NewHAButtonsHandler(
 					return
 				}
 				msg := "OFF"
-				if event.Type == gpiod.LineEventFallingEdge {
+				if services.IsPressed(event) {
 					msg = "ON"
 				}
 				btnCfg, ok := h.buttonsCfgs[event.Offset]
@@ -60,40 +78,78 @@ func NewHAButtonsHandler(
 					log.Error().Msgf("Button %d not found in config", event.Offset)
 					continue
 				}
+				h.mu.Lock()
+				h.buttonStates[event.Offset] = msg
+				h.mu.Unlock()
 				h.sendFeedbackMessage(msg, btnCfg.StateTopic)
 			}
 		}()
 	}
 
-	// build configs
-	for _, button := range conf.Buttons {
-		buttonConf := h.getButtonConfig(button)
-		h.buttonsCfgs[button.GpioInputPin] = buttonConf
+	err := h.Announce()
+	if err != nil {
+		return nil, err
 	}
 
+	h.ticker = time.NewTicker(time.Minute)
+	go func() {
+		for range h.ticker.C {
+			err := h.reportDroppedEvents(false)
+			if err != nil {
+				log.Error().Msgf("failed to report dropped button events: %s", err)
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// Announce sends button configs, availability and last known states to Home Assistant
+func (h *HAButtonsHandler) Announce() error {
 	// send configs
 	for _, button := range h.buttonsCfgs {
 		err := h.sendConfig(button)
 		if err != nil {
-			return nil, fmt.Errorf("failed to send config for button %s, err: %w", button.UniqueID, err)
+			return fmt.Errorf("failed to send config for button %s, err: %w", button.UniqueID, err)
 		}
 		// Home Assistant is slow sometimes while processing new configs... wait a bit
 		time.Sleep(100 * time.Millisecond)
 	}
 
+	err := h.sendDroppedConfig()
+	if err != nil {
+		return fmt.Errorf("failed to send config for sensor %s, err: %w", h.droppedCfg.UniqueID, err)
+	}
+
 	// set all the buttons as available
 	for _, button := range h.buttonsCfgs {
-		token := h.client.Publish(button.AvailabilityTopic, 0, true, "online")
+		token := h.client.Publish(h.availabilityTopic(button.UniqueID), 0, true, "online")
 		if !token.WaitTimeout(2 * time.Second) {
-			return nil, fmt.Errorf("failed to update button %s availability, %w", button.UniqueID, token.Error())
+			return fmt.Errorf("failed to update button %s availability, %w", button.UniqueID, token.Error())
 		}
 	}
 
-	return h, nil
+	// replay last known button states
+	h.mu.Lock()
+	states := make(map[int]string, len(h.buttonStates))
+	for pin, state := range h.buttonStates {
+		states[pin] = state
+	}
+	h.mu.Unlock()
+	for pin, state := range states {
+		err := h.sendFeedbackMessage(state, h.buttonsCfgs[pin].StateTopic)
+		if err != nil {
+			return fmt.Errorf("failed to report button %s state, err: %w", h.buttonsCfgs[pin].UniqueID, err)
+		}
+	}
+	return h.reportDroppedEvents(true)
 }
 
 // Close closes the HAButtonsHandler and performs necessary cleanup
 func (h *HAButtonsHandler) Close() error {
+	if h.ticker != nil {
+		h.ticker.Stop()
+	}
 	for _, sub := range h.svcSubscriptions {
 		err := h.buttonSvc.Unsubscribe(sub.SID)
 		if err != nil {
@@ -107,12 +163,65 @@ func (h *HAButtonsHandler) Close() error {
 func (h *HAButtonsHandler) getButtonConfig(button *config.ButtonConfig) *model.BinarySensor {
 	uid := fmt.Sprintf("button_%d", button.ID)
 	return &model.BinarySensor{
-		Name:              button.Name,
-		UniqueID:          uid,
-		Device:            h.haDevice,
-		StateTopic:        fmt.Sprintf("homeassistant/binary_sensor/%s/state", uid),
-		AvailabilityTopic: fmt.Sprintf("homeassistant/binary_sensor/%s/availability", uid),
+		Name:       button.Name,
+		UniqueID:   uid,
+		Device:     h.haDevice,
+		StateTopic: fmt.Sprintf("homeassistant/binary_sensor/%s/state", uid),
+		Availability: []*model.Availability{
+			{Topic: h.availabilityTopic(uid)},
+			{Topic: h.deviceAvailabilityTopic},
+		},
+		AvailabilityMode: model.AvailabilityModeAll,
+	}
+}
+
+// getDroppedConfig creates a configuration for the dropped button events diagnostic sensor
+func (h *HAButtonsHandler) getDroppedConfig() *model.Sensor {
+	uid := "buttons_dropped_events"
+	return &model.Sensor{
+		Schema:     "json",
+		UniqueID:   uid,
+		Name:       "Dropped Button Events",
+		Device:     h.haDevice,
+		StateTopic: fmt.Sprintf("homeassistant/sensor/%s/state", uid),
+		Availability: []*model.Availability{
+			{Topic: h.deviceAvailabilityTopic},
+		},
+		StateClass:     model.StateClassTotalIncreasing,
+		EntityCategory: model.EntityCategoryDiagnostic,
+		Icon:           "mdi:gesture-tap-button",
+	}
+}
+
+// reportDroppedEvents reports the number of dropped button events if it changed or force is set
+func (h *HAButtonsHandler) reportDroppedEvents(force bool) error {
+	dropped := h.buttonSvc.DroppedEvents()
+	h.mu.Lock()
+	changed := dropped != h.lastDropped
+	h.lastDropped = dropped
+	h.mu.Unlock()
+	if !changed && !force {
+		return nil
 	}
+	return h.sendFeedbackMessage(strconv.FormatUint(dropped, 10), h.droppedCfg.StateTopic)
+}
+
+// sendDroppedConfig sends configuration to Home Assistant for the dropped button events sensor
+func (h *HAButtonsHandler) sendDroppedConfig() error {
+	conf, err := jsoniter.MarshalToString(h.droppedCfg)
+	if err != nil {
+		return err
+	}
+	token := h.client.Publish(fmt.Sprintf("homeassistant/sensor/%s/config", h.droppedCfg.UniqueID), 0, true, conf)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("failed to send config %v: %w", h.droppedCfg, token.Error())
+	}
+	return nil
+}
+
+// availabilityTopic returns the availability topic of a single button
+func (h *HAButtonsHandler) availabilityTopic(uid string) string {
+	return fmt.Sprintf("homeassistant/binary_sensor/%s/availability", uid)
 }
 
 // sendFeedbackMessage sends feedback message to Home Assistant.
@@ -0,0 +1,214 @@
+package controllers
+
+import (
+	"fmt"
+	"rpi-heating-system/app/config"
+	"rpi-heating-system/app/services"
+	"rpi-heating-system/lib/homeassistant/model"
+	"strconv"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// heatFlowSensors holds the Home Assistant sensor configs of a single heat flow
+type heatFlowSensors struct {
+	deltaT *model.Sensor
+	power  *model.Sensor // nil if the heat flow has no flow rate
+	pumpID services.PumpID
+}
+
+// all returns all configured sensors of the heat flow
+func (s *heatFlowSensors) all() []*model.Sensor {
+	if s.power == nil {
+		return []*model.Sensor{s.deltaT}
+	}
+	return []*model.Sensor{s.deltaT, s.power}
+}
+
+// HAHeatFlowHandler is the implementation of HAController interface
+// It publishes temperature differences and thermal power of inlet/outlet sensor pairs as Home Assistant sensors
+type HAHeatFlowHandler struct {
+	client      MQTT.Client
+	heatFlowSvc *services.HeatFlowService
+	haDevice    *model.Device
+	flowCfgs    map[int]*heatFlowSensors
+	ticker      *time.Ticker
+
+	deviceAvailabilityTopic string
+}
+
+// NewHAHeatFlowHandler creates a new instance of HAHeatFlowHandler
+func NewHAHeatFlowHandler(
+	mqttClient MQTT.Client,
+	conf *config.AppConfig,
+	heatFlowSvc *services.HeatFlowService,
+	pumpSvc services.PumpsService,
+) (*HAHeatFlowHandler, error) {
+
+	h := &HAHeatFlowHandler{
+		client:      mqttClient,
+		heatFlowSvc: heatFlowSvc,
+		haDevice:    conf.HADevice,
+		flowCfgs:    make(map[int]*heatFlowSensors),
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
+	}
+
+	// build configs
+	for _, flow := range conf.HeatFlows {
+		h.flowCfgs[flow.ID] = h.getFlowConfig(flow)
+	}
+
+	err := h.Announce()
+	if err != nil {
+		return nil, err
+	}
+
+	// thermal power drops to zero as soon as the linked pump stops
+	pumpSvc.AddStateObserver(func(pumpID services.PumpID, state services.PumpState) {
+		for id, flow := range h.flowCfgs {
+			if flow.power == nil || flow.pumpID != pumpID {
+				continue
+			}
+			err := h.reportHeatFlow(id)
+			if err != nil {
+				log.Error().Msgf("failed to report heat flow %d: %s", id, err)
+			}
+		}
+	})
+
+	h.ticker = time.NewTicker(30 * time.Second)
+	go func() {
+		for range h.ticker.C {
+			for id := range h.flowCfgs {
+				err := h.reportHeatFlow(id)
+				if err != nil {
+					log.Error().Msgf("failed to report heat flow %d: %s", id, err)
+				}
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// Announce sends heat flow sensor configs, availability and current values to Home Assistant
+func (obj *HAHeatFlowHandler) Announce() error {
+	for _, flow := range obj.flowCfgs {
+		for _, sensor := range flow.all() {
+			err := obj.sendConfig(sensor)
+			if err != nil {
+				return fmt.Errorf("failed to send config for sensor %s, err: %w", sensor.UniqueID, err)
+			}
+			// Home Assistant is slow sometimes while processing new configs... wait a bit
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	for _, flow := range obj.flowCfgs {
+		for _, sensor := range flow.all() {
+			token := obj.client.Publish(obj.availabilityTopic(sensor.UniqueID), 0, true, "online")
+			if !token.WaitTimeout(2 * time.Second) {
+				return fmt.Errorf("failed to update sensor %s availability, %w", sensor.UniqueID, token.Error())
+			}
+		}
+	}
+
+	// a failing sensor must not prevent the announcement, the ticker reports the values later
+	for id := range obj.flowCfgs {
+		err := obj.reportHeatFlow(id)
+		if err != nil {
+			log.Error().Msgf("failed to report heat flow %d: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the HAHeatFlowHandler and performs necessary cleanup
+func (obj *HAHeatFlowHandler) Close() error {
+	obj.ticker.Stop()
+	return nil
+}
+
+// reportHeatFlow calculates the heat flow values and reports them to Home Assistant
+func (obj *HAHeatFlowHandler) reportHeatFlow(id int) error {
+	flow := obj.flowCfgs[id]
+	reading, err := obj.heatFlowSvc.Calculate(id)
+	if err != nil {
+		return err
+	}
+	err = obj.sendFeedbackMessage(strconv.FormatFloat(reading.DeltaT, 'f', 2, 64), flow.deltaT.StateTopic)
+	if err != nil {
+		return err
+	}
+	if flow.power == nil || !reading.HasPower {
+		return nil
+	}
+	return obj.sendFeedbackMessage(strconv.FormatFloat(reading.PowerKW, 'f', 2, 64), flow.power.StateTopic)
+}
+
+// getFlowConfig creates configurations for the sensors of a heat flow
+func (obj *HAHeatFlowHandler) getFlowConfig(flowCfg *config.HeatFlowConfig) *heatFlowSensors {
+	uid := fmt.Sprintf("heat_flow_%d", flowCfg.ID)
+	sensors := &heatFlowSensors{
+		deltaT: obj.getSensorConfig(uid+"_delta_t", flowCfg.Name+" Delta T"),
+		pumpID: services.PumpID(flowCfg.PumpID),
+	}
+	sensors.deltaT.DeviceClass = "temperature"
+	sensors.deltaT.UnitOfMeasurement = "°C"
+	sensors.deltaT.StateClass = model.StateClassMeasurement
+
+	if flowCfg.FlowLitersPerMinute > 0 {
+		sensors.power = obj.getSensorConfig(uid+"_power", flowCfg.Name+" Power")
+		sensors.power.DeviceClass = "power"
+		sensors.power.UnitOfMeasurement = "kW"
+		sensors.power.StateClass = model.StateClassMeasurement
+	}
+	return sensors
+}
+
+// getSensorConfig creates a base configuration for a heat flow sensor
+func (obj *HAHeatFlowHandler) getSensorConfig(uid string, name string) *model.Sensor {
+	return &model.Sensor{
+		Schema:     "json",
+		UniqueID:   uid,
+		Name:       name,
+		Device:     obj.haDevice,
+		StateTopic: fmt.Sprintf("homeassistant/sensor/%s/state", uid),
+		Availability: []*model.Availability{
+			{Topic: obj.availabilityTopic(uid)},
+			{Topic: obj.deviceAvailabilityTopic},
+		},
+		AvailabilityMode: model.AvailabilityModeAll,
+	}
+}
+
+// availabilityTopic returns the availability topic of a single sensor
+func (obj *HAHeatFlowHandler) availabilityTopic(uid string) string {
+	return fmt.Sprintf("homeassistant/sensor/%s/status", uid)
+}
+
+// sendFeedbackMessage sends feedback message to Home Assistant.
+func (obj *HAHeatFlowHandler) sendFeedbackMessage(msg string, stateTopic string) error {
+	token := obj.client.Publish(stateTopic, 0, true, msg)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("failed to send feedback message to topic %s: %w", stateTopic, token.Error())
+	}
+	return nil
+}
+
+// sendConfig sends configuration to Home Assistant for a sensor
+func (obj *HAHeatFlowHandler) sendConfig(sensor *model.Sensor) error {
+	conf, err := jsoniter.MarshalToString(sensor)
+	if err != nil {
+		return err
+	}
+	token := obj.client.Publish(fmt.Sprintf("homeassistant/sensor/%s/config", sensor.UniqueID), 0, true, conf)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("failed to send config %v: %w", sensor, token.Error())
+	}
+	return nil
+}
@@ -1,11 +1,13 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"rpi-heating-system/app/config"
 	"rpi-heating-system/app/services"
 	"rpi-heating-system/lib"
 	"rpi-heating-system/lib/homeassistant/model"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -15,12 +17,29 @@ import (
 	jsoniter "github.com/json-iterator/go"
 )
 
+// pumpAttributes are additional pump attributes shown in Home Assistant
+// They explain why the switch state differs from the last command
+type pumpAttributes struct {
+	PendingState   string `json:"pending_state,omitempty"`
+	PendingUntil   string `json:"pending_until,omitempty"`
+	RejectedState  string `json:"rejected_state,omitempty"`
+	RejectedAt     string `json:"rejected_at,omitempty"`
+	RejectedReason string `json:"rejected_reason,omitempty"`
+}
+
+// PumpCommandObserver is called when a pump command is received from Home Assistant, before it is applied
+type PumpCommandObserver func(pumpID services.PumpID, state services.PumpState)
+
 // HAHeatingPumpsHandler is the implementation of HAController interface
 type HAHeatingPumpsHandler struct {
-	client   MQTT.Client
-	pumpsSvc services.PumpsService
-	haDevice *model.Device
-	pumpCfgs map[services.PumpID]*model.Switch
+	client           MQTT.Client
+	pumpsSvc         services.PumpsService
+	haDevice         *model.Device
+	pumpCfgs         map[services.PumpID]*model.Switch
+	mu               sync.Mutex
+	commandObservers []PumpCommandObserver
+
+	deviceAvailabilityTopic string
 }
 
 // NewHAHeatingPumpsHandler creates a new instance of HAHeatingPumpsHandler
@@ -35,6 +54,8 @@ func NewHAHeatingPumpsHandler(
 		pumpsSvc: pumpSvc,
 		haDevice: conf.HADevice,
 		pumpCfgs: make(map[services.PumpID]*model.Switch),
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
 	}
 
 	// build configs
@@ -43,40 +64,59 @@ func NewHAHeatingPumpsHandler(
 		h.pumpCfgs[services.PumpID(pump.ID)] = pumpConf
 	}
 
+	err := h.Announce()
+	if err != nil {
+		return nil, err
+	}
+
+	// report state changes that do not come from Home Assistant, e.g. local thermostats
+	pumpSvc.AddStateObserver(h.onPumpStateChange)
+
+	return h, nil
+}
+
+// Announce sends pump configs, availability and states to Home Assistant and subscribes to command topics
+func (obj *HAHeatingPumpsHandler) Announce() error {
 	// send configs to HA
-	for _, pump := range h.pumpCfgs {
-		err := h.sendConfig(pump)
+	for _, pump := range obj.pumpCfgs {
+		err := obj.sendConfig(pump)
 		if err != nil {
-			return nil, fmt.Errorf("failed to send config for pump %s, err: %w", pump.Name, err)
+			return fmt.Errorf("failed to send config for pump %s, err: %w", pump.Name, err)
 		}
 		// Home Assistant is slow sometimes while processing new configs... wait a bit
 		time.Sleep(100 * time.Millisecond)
 	}
 
 	// set all the pumps as available
-	for _, pump := range h.pumpCfgs {
-		token := h.client.Publish(pump.AvailabilityTopic, 0, true, "online")
+	for _, pump := range obj.pumpCfgs {
+		token := obj.client.Publish(obj.availabilityTopic(pump.UniqueID), 0, true, "online")
 		if !token.WaitTimeout(2 * time.Second) {
-			return nil, fmt.Errorf("failed to update pump availability, %w", token.Error())
+			return fmt.Errorf("failed to update pump availability, %w", token.Error())
 		}
 	}
 
 	// report pumps states
-	for id, pump := range h.pumpCfgs {
-		err := h.reportPumpState(services.PumpID(id), pump)
+	for id, pump := range obj.pumpCfgs {
+		err := obj.reportPumpState(services.PumpID(id), pump)
 		if err != nil {
-			return nil, fmt.Errorf("failed to report pump %s state, err: %w", pump.Name, err)
+			return fmt.Errorf("failed to report pump %s state, err: %w", pump.Name, err)
 		}
 	}
 
 	// subscribe to HA commands
-	for _, pump := range h.pumpCfgs {
-		if token := h.client.Subscribe(pump.CommandTopic, 1, h.onHACommand); token.Wait() && token.Error() != nil {
-			return nil, fmt.Errorf("failed to subscribe to pump command topic, %w", token.Error())
+	for _, pump := range obj.pumpCfgs {
+		if token := obj.client.Subscribe(pump.CommandTopic, 1, obj.onHACommand); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("failed to subscribe to pump command topic, %w", token.Error())
 		}
 	}
+	return nil
+}
 
-	return h, nil
+// AddCommandObserver registers an observer that is notified about every Home Assistant pump command
+func (obj *HAHeatingPumpsHandler) AddCommandObserver(observer PumpCommandObserver) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.commandObservers = append(obj.commandObservers, observer)
 }
 
 // Close closes the HAHeatingPumpsHandler and performs necessary cleanup
@@ -108,11 +148,33 @@ func (obj *HAHeatingPumpsHandler) onHACommand(client MQTT.Client, msg MQTT.Messa
 			if string(msg.Payload()) == "ON" {
 				state = services.PumpON
 			}
+			obj.mu.Lock()
+			observers := obj.commandObservers
+			obj.mu.Unlock()
+			for _, observer := range observers {
+				observer(services.PumpID(id), state)
+			}
+			attrs := &pumpAttributes{}
+			var delayedErr *services.SwitchDelayedError
 			err := obj.pumpsSvc.SetPumpState(services.PumpID(id), state)
-			if err != nil {
+			switch {
+			case errors.As(err, &delayedErr):
+				attrs.PendingState = stateToPayload(delayedErr.State)
+				attrs.PendingUntil = delayedErr.Until.Format(time.RFC3339)
+			case errors.Is(err, services.ErrSwitchRejected), errors.Is(err, services.ErrPumpInterlocked),
+				errors.Is(err, services.ErrPumpOverridden):
+				log.Warn().Msgf("Pump %s command %s rejected: %s", pump.Name, msg.Payload(), err)
+				attrs.RejectedState = stateToPayload(state)
+				attrs.RejectedAt = time.Now().Format(time.RFC3339)
+				attrs.RejectedReason = err.Error()
+			case err != nil:
 				lib.Panic(fmt.Errorf("failed to set pump state: %s", err))
-
 			}
+			err = obj.sendAttributes(attrs, pump)
+			if err != nil {
+				log.Error().Msgf("failed to report pump %s attributes: %s", pump.Name, err)
+			}
+			// a delayed or rejected command leaves the pump in its previous state, report the real one
 			err = obj.reportPumpState(services.PumpID(id), pump)
 			if err != nil {
 				lib.Panic(fmt.Errorf("failed to report pump state: %s", err))
@@ -121,33 +183,76 @@ func (obj *HAHeatingPumpsHandler) onHACommand(client MQTT.Client, msg MQTT.Messa
 	}
 }
 
+// onPumpStateChange is a callback for pump state changes made by any source
+func (obj *HAHeatingPumpsHandler) onPumpStateChange(pumpID services.PumpID, state services.PumpState) {
+	pump, ok := obj.pumpCfgs[pumpID]
+	if !ok {
+		return
+	}
+	err := obj.reportPumpState(pumpID, pump)
+	if err != nil {
+		log.Error().Msgf("failed to report pump %s state: %s", pump.Name, err)
+	}
+	// a delayed switch has been applied or the state was set by another source, nothing is pending anymore
+	err = obj.sendAttributes(&pumpAttributes{}, pump)
+	if err != nil {
+		log.Error().Msgf("failed to report pump %s attributes: %s", pump.Name, err)
+	}
+}
+
 // reportPumpState reports the current state of a pump to Home Assistant
 func (obj *HAHeatingPumpsHandler) reportPumpState(pumpID services.PumpID, pump *model.Switch) error {
 	state, err := obj.pumpsSvc.GetPumpState(pumpID)
 	if err != nil {
 		return fmt.Errorf("failed to update pump ON/OFF state for pump %s, err: %w", pump.Name, err)
 	}
-	msg := "OFF"
+	return obj.sendFeedbackMessage(stateToPayload(state), pump.StateTopic)
+}
+
+// sendAttributes publishes the pump attributes to Home Assistant
+func (obj *HAHeatingPumpsHandler) sendAttributes(attrs *pumpAttributes, pump *model.Switch) error {
+	if pump.JSONAttributesTopic == "" {
+		return fmt.Errorf("pump %s has no attributes topic", pump.Name)
+	}
+	msg, err := jsoniter.MarshalToString(attrs)
+	if err != nil {
+		return err
+	}
+	return obj.sendFeedbackMessage(msg, pump.JSONAttributesTopic)
+}
+
+// stateToPayload converts the pump state to the Home Assistant switch payload
+func stateToPayload(state services.PumpState) string {
 	if state == services.PumpON {
-		msg = "ON"
+		return "ON"
 	}
-	return obj.sendFeedbackMessage(msg, pump.StateTopic)
+	return "OFF"
 }
 
 // getPumpConfig creates a configuration for a pump
 func (obj *HAHeatingPumpsHandler) getPumpConfig(pumpCfg *config.PumpConfig) *model.Switch {
 	uid := fmt.Sprintf("heating_pump_%d", pumpCfg.ID)
 	return &model.Switch{
-		Schema:            "json",
-		UniqueID:          uid,
-		Name:              pumpCfg.Name,
-		Device:            obj.haDevice,
-		CommandTopic:      fmt.Sprintf("homeassistant/switch/%s/set", uid),
-		StateTopic:        fmt.Sprintf("homeassistant/switch/%s/state", uid),
-		AvailabilityTopic: fmt.Sprintf("homeassistant/switch/%s/status", uid),
+		Schema:       "json",
+		UniqueID:     uid,
+		Name:         pumpCfg.Name,
+		Device:       obj.haDevice,
+		CommandTopic: fmt.Sprintf("homeassistant/switch/%s/set", uid),
+		StateTopic:   fmt.Sprintf("homeassistant/switch/%s/state", uid),
+		Availability: []*model.Availability{
+			{Topic: obj.availabilityTopic(uid)},
+			{Topic: obj.deviceAvailabilityTopic},
+		},
+		AvailabilityMode:    model.AvailabilityModeAll,
+		JSONAttributesTopic: fmt.Sprintf("homeassistant/switch/%s/attributes", uid),
 	}
 }
 
+// availabilityTopic returns the availability topic of a single pump
+func (obj *HAHeatingPumpsHandler) availabilityTopic(uid string) string {
+	return fmt.Sprintf("homeassistant/switch/%s/status", uid)
+}
+
 // sendFeedbackMessage sends feedback message to Home Assistant.
 func (obj *HAHeatingPumpsHandler) sendFeedbackMessage(msg string, stateTopic string) error {
 	token := obj.client.Publish(stateTopic, 0, true, msg)
@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"fmt"
+	"rpi-heating-system/app/config"
+	"rpi-heating-system/app/services"
+	"rpi-heating-system/lib/homeassistant/model"
+	"strconv"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// HAHumidityHandler is the implementation of HAController interface
+// It publishes the relative humidity of sensors that measure it as Home Assistant sensors
+type HAHumidityHandler struct {
+	client     MQTT.Client
+	registry   *services.TempSensorRegistry
+	haDevice   *model.Device
+	sensorCfgs map[string]*model.Sensor
+	ticker     *time.Ticker
+
+	deviceAvailabilityTopic string
+}
+
+// NewHAHumidityHandler creates a new instance of HAHumidityHandler
+func NewHAHumidityHandler(
+	mqttClient MQTT.Client,
+	conf *config.AppConfig,
+	registry *services.TempSensorRegistry,
+) (*HAHumidityHandler, error) {
+
+	h := &HAHumidityHandler{
+		client:     mqttClient,
+		registry:   registry,
+		haDevice:   conf.HADevice,
+		sensorCfgs: make(map[string]*model.Sensor),
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
+	}
+
+	// build configs
+	humidity := make(map[string]bool)
+	for _, id := range registry.HumiditySensors() {
+		humidity[id] = true
+	}
+	for _, sensor := range conf.TempSensors {
+		if humidity[sensor.ID] && sensor.BME280 != nil && sensor.BME280.PublishHumidity {
+			h.sensorCfgs[sensor.ID] = h.getSensorConfig(sensor)
+		}
+	}
+
+	err := h.Announce()
+	if err != nil {
+		return nil, err
+	}
+
+	h.ticker = time.NewTicker(time.Minute)
+	go func() {
+		for range h.ticker.C {
+			for id := range h.sensorCfgs {
+				err := h.reportHumidity(id)
+				if err != nil {
+					log.Error().Msgf("failed to report sensor %s humidity: %s", id, err)
+				}
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// Announce sends humidity sensor configs, availability and current values to Home Assistant
+func (obj *HAHumidityHandler) Announce() error {
+	for _, sensor := range obj.sensorCfgs {
+		err := obj.sendConfig(sensor)
+		if err != nil {
+			return fmt.Errorf("failed to send config for sensor %s, err: %w", sensor.UniqueID, err)
+		}
+		// Home Assistant is slow sometimes while processing new configs... wait a bit
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, sensor := range obj.sensorCfgs {
+		token := obj.client.Publish(obj.availabilityTopic(sensor.UniqueID), 0, true, "online")
+		if !token.WaitTimeout(2 * time.Second) {
+			return fmt.Errorf("failed to update sensor %s availability, %w", sensor.UniqueID, token.Error())
+		}
+	}
+
+	// a failing sensor must not prevent the announcement, the ticker reports the values later
+	for id := range obj.sensorCfgs {
+		err := obj.reportHumidity(id)
+		if err != nil {
+			log.Error().Msgf("failed to report sensor %s humidity: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the HAHumidityHandler and performs necessary cleanup
+func (obj *HAHumidityHandler) Close() error {
+	obj.ticker.Stop()
+	return nil
+}
+
+// reportHumidity reads the humidity of the sensor and reports it to Home Assistant
+func (obj *HAHumidityHandler) reportHumidity(id string) error {
+	humidity, err := obj.registry.ReadHumidity(id)
+	if err != nil {
+		return err
+	}
+	return obj.sendFeedbackMessage(strconv.FormatFloat(humidity, 'f', 1, 64), obj.sensorCfgs[id].StateTopic)
+}
+
+// getSensorConfig creates a configuration for a humidity sensor
+func (obj *HAHumidityHandler) getSensorConfig(cfg *config.TempSensorsConfig) *model.Sensor {
+	uid := fmt.Sprintf("humidity_%s", cfg.ID)
+	return &model.Sensor{
+		Schema:     "json",
+		UniqueID:   uid,
+		Name:       cfg.Name + " Humidity",
+		Device:     obj.haDevice,
+		StateTopic: fmt.Sprintf("homeassistant/sensor/%s/state", uid),
+		Availability: []*model.Availability{
+			{Topic: obj.availabilityTopic(uid)},
+			{Topic: obj.deviceAvailabilityTopic},
+		},
+		AvailabilityMode:  model.AvailabilityModeAll,
+		DeviceClass:       "humidity",
+		StateClass:        model.StateClassMeasurement,
+		UnitOfMeasurement: "%",
+	}
+}
+
+// availabilityTopic returns the availability topic of a single sensor
+func (obj *HAHumidityHandler) availabilityTopic(uid string) string {
+	return fmt.Sprintf("homeassistant/sensor/%s/status", uid)
+}
+
+// sendFeedbackMessage sends feedback message to Home Assistant.
+func (obj *HAHumidityHandler) sendFeedbackMessage(msg string, stateTopic string) error {
+	token := obj.client.Publish(stateTopic, 0, true, msg)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("failed to send feedback message to topic %s: %w", stateTopic, token.Error())
+	}
+	return nil
+}
+
+// sendConfig sends configuration to Home Assistant for a sensor
+func (obj *HAHumidityHandler) sendConfig(sensor *model.Sensor) error {
+	conf, err := jsoniter.MarshalToString(sensor)
+	if err != nil {
+		return err
+	}
+	token := obj.client.Publish(fmt.Sprintf("homeassistant/sensor/%s/config", sensor.UniqueID), 0, true, conf)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("failed to send config %v: %w", sensor, token.Error())
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"fmt"
+	"rpi-heating-system/app/config"
+	"rpi-heating-system/app/services"
+	"rpi-heating-system/lib/homeassistant/model"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// HALocalControlHandler is the implementation of HAController interface
+// It publishes which control mode is active as a Home Assistant sensor
+type HALocalControlHandler struct {
+	client          MQTT.Client
+	localControlSvc *services.LocalControlService
+	haDevice        *model.Device
+	modeCfg         *model.Sensor
+
+	deviceAvailabilityTopic string
+}
+
+// NewHALocalControlHandler creates a new instance of HALocalControlHandler
+func NewHALocalControlHandler(
+	mqttClient MQTT.Client,
+	conf *config.AppConfig,
+	localControlSvc *services.LocalControlService,
+) (*HALocalControlHandler, error) {
+
+	h := &HALocalControlHandler{
+		client:          mqttClient,
+		localControlSvc: localControlSvc,
+		haDevice:        conf.HADevice,
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
+	}
+	h.modeCfg = h.getModeConfig()
+
+	err := h.Announce()
+	if err != nil {
+		return nil, err
+	}
+
+	localControlSvc.AddModeObserver(func(mode services.ControlMode) {
+		err := h.sendFeedbackMessage(string(mode), h.modeCfg.StateTopic)
+		if err != nil {
+			log.Error().Msgf("failed to report control mode: %s", err)
+		}
+	})
+
+	return h, nil
+}
+
+// Announce sends the control mode sensor config, availability and the current mode to Home Assistant
+func (obj *HALocalControlHandler) Announce() error {
+	err := obj.sendConfig(obj.modeCfg)
+	if err != nil {
+		return fmt.Errorf("failed to send config for sensor %s, err: %w", obj.modeCfg.UniqueID, err)
+	}
+	// Home Assistant is slow sometimes while processing new configs... wait a bit
+	time.Sleep(100 * time.Millisecond)
+
+	token := obj.client.Publish(obj.availabilityTopic(obj.modeCfg.UniqueID), 0, true, "online")
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("failed to update sensor %s availability, %w", obj.modeCfg.UniqueID, token.Error())
+	}
+
+	return obj.sendFeedbackMessage(string(obj.localControlSvc.Mode()), obj.modeCfg.StateTopic)
+}
+
+// Close closes the HALocalControlHandler and performs necessary cleanup
+func (obj *HALocalControlHandler) Close() error {
+	return nil
+}
+
+// getModeConfig creates a configuration for the control mode sensor
+func (obj *HALocalControlHandler) getModeConfig() *model.Sensor {
+	uid := "heating_control_mode"
+	return &model.Sensor{
+		Schema:     "json",
+		UniqueID:   uid,
+		Name:       "Control Mode",
+		Device:     obj.haDevice,
+		StateTopic: fmt.Sprintf("homeassistant/sensor/%s/state", uid),
+		Availability: []*model.Availability{
+			{Topic: obj.availabilityTopic(uid)},
+			{Topic: obj.deviceAvailabilityTopic},
+		},
+		AvailabilityMode: model.AvailabilityModeAll,
+		DeviceClass:      "enum",
+		Options:          []string{string(services.ControlModeHA), string(services.ControlModeLocal)},
+		Icon:             "mdi:thermostat-auto",
+	}
+}
+
+// availabilityTopic returns the availability topic of a single sensor
+func (obj *HALocalControlHandler) availabilityTopic(uid string) string {
+	return fmt.Sprintf("homeassistant/sensor/%s/status", uid)
+}
+
+// sendFeedbackMessage sends feedback message to Home Assistant.
+func (obj *HALocalControlHandler) sendFeedbackMessage(msg string, stateTopic string) error {
+	token := obj.client.Publish(stateTopic, 0, true, msg)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("failed to send feedback message to topic %s: %w", stateTopic, token.Error())
+	}
+	return nil
+}
+
+// sendConfig sends configuration to Home Assistant for a sensor
+func (obj *HALocalControlHandler) sendConfig(sensor *model.Sensor) error {
+	conf, err := jsoniter.MarshalToString(sensor)
+	if err != nil {
+		return err
+	}
+	token := obj.client.Publish(fmt.Sprintf("homeassistant/sensor/%s/config", sensor.UniqueID), 0, true, conf)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("failed to send config %v: %w", sensor, token.Error())
+	}
+	return nil
+}
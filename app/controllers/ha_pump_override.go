@@ -0,0 +1,319 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"rpi-heating-system/app/config"
+	"rpi-heating-system/app/services"
+	"rpi-heating-system/lib/homeassistant/model"
+	"strconv"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// maxOverrideMinutes is the longest override that can be set from Home Assistant, one day
+const maxOverrideMinutes = 24 * 60
+
+// pumpOverrideEntities holds the Home Assistant entity configs of a single pump's override
+type pumpOverrideEntities struct {
+	minutes   *model.Number
+	on        *model.Button
+	off       *model.Button
+	cancel    *model.Button
+	remaining *model.Sensor
+}
+
+// HAPumpOverrideHandler is the implementation of HAController interface
+// It lets Home Assistant override pumps for a number of minutes and publishes the remaining override time
+type HAPumpOverrideHandler struct {
+	client       MQTT.Client
+	overrideSvc  *services.OverrideService
+	haDevice     *model.Device
+	overrideCfgs map[services.PumpID]*pumpOverrideEntities
+	mu           sync.Mutex
+	durations    map[services.PumpID]time.Duration // override duration set by the number entity
+	ticker       *time.Ticker
+
+	deviceAvailabilityTopic string
+}
+
+// NewHAPumpOverrideHandler creates a new instance of HAPumpOverrideHandler
+func NewHAPumpOverrideHandler(
+	mqttClient MQTT.Client,
+	conf *config.AppConfig,
+	overrideSvc *services.OverrideService,
+) (*HAPumpOverrideHandler, error) {
+
+	h := &HAPumpOverrideHandler{
+		client:       mqttClient,
+		overrideSvc:  overrideSvc,
+		haDevice:     conf.HADevice,
+		overrideCfgs: make(map[services.PumpID]*pumpOverrideEntities),
+		durations:    make(map[services.PumpID]time.Duration),
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
+	}
+
+	// build configs
+	for _, pump := range conf.Pumps {
+		pumpID := services.PumpID(pump.ID)
+		h.overrideCfgs[pumpID] = h.getOverrideConfig(pump)
+		h.durations[pumpID] = overrideSvc.DefaultDuration(pumpID)
+	}
+
+	err := h.Announce()
+	if err != nil {
+		return nil, err
+	}
+
+	overrideSvc.AddOverrideObserver(func(pumpID services.PumpID, _ *services.PumpOverride) {
+		err := h.reportRemaining(pumpID)
+		if err != nil {
+			log.Error().Msgf("failed to report pump %d override: %s", pumpID, err)
+		}
+	})
+
+	h.ticker = time.NewTicker(30 * time.Second)
+	go func() {
+		for range h.ticker.C {
+			for pumpID := range h.overrideCfgs {
+				err := h.reportRemaining(pumpID)
+				if err != nil {
+					log.Error().Msgf("failed to report pump %d override: %s", pumpID, err)
+				}
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// Announce sends override entity configs, availability and states to Home Assistant and subscribes to command topics
+func (obj *HAPumpOverrideHandler) Announce() error {
+	for _, entities := range obj.overrideCfgs {
+		configs := []struct {
+			component string
+			uid       string
+			entity    any
+		}{
+			{"number", entities.minutes.UniqueID, entities.minutes},
+			{"button", entities.on.UniqueID, entities.on},
+			{"button", entities.off.UniqueID, entities.off},
+			{"button", entities.cancel.UniqueID, entities.cancel},
+			{"sensor", entities.remaining.UniqueID, entities.remaining},
+		}
+		for _, cfg := range configs {
+			err := obj.sendConfig(cfg.component, cfg.uid, cfg.entity)
+			if err != nil {
+				return fmt.Errorf("failed to send config for %s %s, err: %w", cfg.component, cfg.uid, err)
+			}
+			token := obj.client.Publish(obj.availabilityTopic(cfg.component, cfg.uid), 0, true, "online")
+			if !token.WaitTimeout(2 * time.Second) {
+				return fmt.Errorf("failed to update %s %s availability, %w", cfg.component, cfg.uid, token.Error())
+			}
+		}
+		// Home Assistant is slow sometimes while processing new configs... wait a bit
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for pumpID := range obj.overrideCfgs {
+		err := obj.reportDuration(pumpID)
+		if err != nil {
+			return fmt.Errorf("failed to report pump %d override duration, err: %w", pumpID, err)
+		}
+		err = obj.reportRemaining(pumpID)
+		if err != nil {
+			return fmt.Errorf("failed to report pump %d override, err: %w", pumpID, err)
+		}
+	}
+
+	for _, topic := range obj.commandTopics() {
+		if token := obj.client.Subscribe(topic, 1, obj.onHACommand); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("failed to subscribe to override command topic, %w", token.Error())
+		}
+	}
+	return nil
+}
+
+// Close closes the HAPumpOverrideHandler and performs necessary cleanup
+func (obj *HAPumpOverrideHandler) Close() error {
+	if obj.ticker != nil {
+		obj.ticker.Stop()
+	}
+	for _, topic := range obj.commandTopics() {
+		if token := obj.client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("failed to unsubscribe from override command topic, %w", token.Error())
+		}
+	}
+	return nil
+}
+
+// commandTopics returns the command topics of all override entities
+func (obj *HAPumpOverrideHandler) commandTopics() []string {
+	var topics []string
+	for _, entities := range obj.overrideCfgs {
+		topics = append(topics,
+			entities.minutes.CommandTopic,
+			entities.on.CommandTopic,
+			entities.off.CommandTopic,
+			entities.cancel.CommandTopic,
+		)
+	}
+	return topics
+}
+
+// onHACommand is a callback function for processing Home Assistant override commands
+func (obj *HAPumpOverrideHandler) onHACommand(client MQTT.Client, msg MQTT.Message) {
+	log.Debug().Msgf("Rx HA: Topic: [%s], Payload: [%s]", msg.Topic(), msg.Payload())
+	for pumpID, entities := range obj.overrideCfgs {
+		var err error
+		switch msg.Topic() {
+		case entities.minutes.CommandTopic:
+			err = obj.setDuration(pumpID, string(msg.Payload()))
+		case entities.on.CommandTopic:
+			err = obj.overrideSvc.Override(pumpID, services.PumpON, obj.duration(pumpID))
+		case entities.off.CommandTopic:
+			err = obj.overrideSvc.Override(pumpID, services.PumpOFF, obj.duration(pumpID))
+		case entities.cancel.CommandTopic:
+			err = obj.overrideSvc.Cancel(pumpID)
+		default:
+			continue
+		}
+		if err != nil {
+			log.Error().Msgf("pump %d override command on %s failed: %s", pumpID, msg.Topic(), err)
+		}
+	}
+}
+
+// setDuration sets the override duration of the pump from the number entity payload
+func (obj *HAPumpOverrideHandler) setDuration(pumpID services.PumpID, payload string) error {
+	value, err := strconv.ParseFloat(payload, 64)
+	if err != nil {
+		return fmt.Errorf("invalid override minutes %q: %w", payload, err)
+	}
+	// the number entity may send fractions, durations are kept in whole minutes
+	minutes := math.Round(value)
+	if !(minutes >= 1 && minutes <= maxOverrideMinutes) {
+		return fmt.Errorf("override minutes %q outside of 1..%d", payload, maxOverrideMinutes)
+	}
+	obj.mu.Lock()
+	obj.durations[pumpID] = time.Duration(minutes) * time.Minute
+	obj.mu.Unlock()
+	// report the stored value so Home Assistant shows the rounded minutes
+	return obj.reportDuration(pumpID)
+}
+
+// duration returns the override duration of the pump
+func (obj *HAPumpOverrideHandler) duration(pumpID services.PumpID) time.Duration {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	return obj.durations[pumpID]
+}
+
+// reportDuration reports the override duration of the pump to Home Assistant
+func (obj *HAPumpOverrideHandler) reportDuration(pumpID services.PumpID) error {
+	minutes := int(obj.duration(pumpID) / time.Minute)
+	return obj.sendFeedbackMessage(strconv.Itoa(minutes), obj.overrideCfgs[pumpID].minutes.StateTopic)
+}
+
+// reportRemaining reports the remaining override time of the pump in whole minutes, 0 without an override
+func (obj *HAPumpOverrideHandler) reportRemaining(pumpID services.PumpID) error {
+	minutes := 0
+	override, ok := obj.overrideSvc.ActiveOverride(pumpID)
+	if ok {
+		minutes = int(math.Ceil(time.Until(override.Until).Minutes()))
+	}
+	return obj.sendFeedbackMessage(strconv.Itoa(minutes), obj.overrideCfgs[pumpID].remaining.StateTopic)
+}
+
+// getOverrideConfig creates configurations for the override entities of a pump
+func (obj *HAPumpOverrideHandler) getOverrideConfig(pump *config.PumpConfig) *pumpOverrideEntities {
+	uid := fmt.Sprintf("pump_override_%d", pump.ID)
+	availability := func(component string, uid string) []*model.Availability {
+		return []*model.Availability{
+			{Topic: obj.availabilityTopic(component, uid)},
+			{Topic: obj.deviceAvailabilityTopic},
+		}
+	}
+	button := func(suffix string, name string, icon string) *model.Button {
+		buttonUID := uid + "_" + suffix
+		return &model.Button{
+			Schema:           "json",
+			UniqueID:         buttonUID,
+			Name:             name,
+			Device:           obj.haDevice,
+			CommandTopic:     fmt.Sprintf("homeassistant/button/%s/set", buttonUID),
+			Availability:     availability("button", buttonUID),
+			AvailabilityMode: model.AvailabilityModeAll,
+			Icon:             icon,
+		}
+	}
+
+	minutesUID := uid + "_minutes"
+	remainingUID := uid + "_remaining"
+	return &pumpOverrideEntities{
+		minutes: &model.Number{
+			Schema:            "json",
+			UniqueID:          minutesUID,
+			Name:              pump.Name + " Override Duration",
+			Device:            obj.haDevice,
+			StateTopic:        fmt.Sprintf("homeassistant/number/%s/state", minutesUID),
+			CommandTopic:      fmt.Sprintf("homeassistant/number/%s/set", minutesUID),
+			Availability:      availability("number", minutesUID),
+			AvailabilityMode:  model.AvailabilityModeAll,
+			Min:               1,
+			Max:               maxOverrideMinutes,
+			Step:              1,
+			Mode:              model.NumberModeBox,
+			UnitOfMeasurement: "min",
+			EntityCategory:    model.EntityCategoryConfig,
+			Icon:              "mdi:timer-cog-outline",
+		},
+		on:     button("on", pump.Name+" Override ON", "mdi:pump"),
+		off:    button("off", pump.Name+" Override OFF", "mdi:pump-off"),
+		cancel: button("cancel", pump.Name+" Cancel Override", "mdi:restore"),
+		remaining: &model.Sensor{
+			Schema:            "json",
+			UniqueID:          remainingUID,
+			Name:              pump.Name + " Override Remaining",
+			Device:            obj.haDevice,
+			StateTopic:        fmt.Sprintf("homeassistant/sensor/%s/state", remainingUID),
+			Availability:      availability("sensor", remainingUID),
+			AvailabilityMode:  model.AvailabilityModeAll,
+			DeviceClass:       "duration",
+			UnitOfMeasurement: "min",
+			Icon:              "mdi:timer-sand",
+		},
+	}
+}
+
+// availabilityTopic returns the availability topic of a single entity
+func (obj *HAPumpOverrideHandler) availabilityTopic(component string, uid string) string {
+	return fmt.Sprintf("homeassistant/%s/%s/status", component, uid)
+}
+
+// sendFeedbackMessage sends feedback message to Home Assistant.
+func (obj *HAPumpOverrideHandler) sendFeedbackMessage(msg string, stateTopic string) error {
+	token := obj.client.Publish(stateTopic, 0, true, msg)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("failed to send feedback message to topic %s: %w", stateTopic, token.Error())
+	}
+	return nil
+}
+
+// sendConfig sends configuration to Home Assistant for an entity of the component
+func (obj *HAPumpOverrideHandler) sendConfig(component string, uid string, entity any) error {
+	conf, err := jsoniter.MarshalToString(entity)
+	if err != nil {
+		return err
+	}
+	token := obj.client.Publish(fmt.Sprintf("homeassistant/%s/%s/config", component, uid), 0, true, conf)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("failed to send config %v: %w", entity, token.Error())
+	}
+	return nil
+}
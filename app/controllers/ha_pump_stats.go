@@ -0,0 +1,235 @@
+package controllers
+
+import (
+	"fmt"
+	"rpi-heating-system/app/config"
+	"rpi-heating-system/app/services"
+	"rpi-heating-system/lib/homeassistant/model"
+	"strconv"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// pumpStatsSensors holds the Home Assistant sensor configs of a single pump accounting
+type pumpStatsSensors struct {
+	runtime *model.Sensor
+	starts  *model.Sensor
+	lastOn  *model.Sensor
+	lastOff *model.Sensor
+	energy  *model.Sensor // nil if the pump has no rated wattage
+}
+
+// all returns all configured sensors of the pump
+func (s *pumpStatsSensors) all() []*model.Sensor {
+	sensors := []*model.Sensor{s.runtime, s.starts, s.lastOn, s.lastOff}
+	if s.energy != nil {
+		sensors = append(sensors, s.energy)
+	}
+	return sensors
+}
+
+// HAPumpStatsHandler is the implementation of HAController interface
+// It publishes pump runtime, start counter and energy accounting as Home Assistant sensors
+type HAPumpStatsHandler struct {
+	client    MQTT.Client
+	pumpsSvc  services.PumpsService
+	haDevice  *model.Device
+	statsCfgs map[services.PumpID]*pumpStatsSensors
+	ticker    *time.Ticker
+
+	deviceAvailabilityTopic string
+}
+
+// NewHAPumpStatsHandler creates a new instance of HAPumpStatsHandler
+func NewHAPumpStatsHandler(
+	mqttClient MQTT.Client,
+	conf *config.AppConfig,
+	pumpSvc services.PumpsService,
+) (*HAPumpStatsHandler, error) {
+
+	h := &HAPumpStatsHandler{
+		client:    mqttClient,
+		pumpsSvc:  pumpSvc,
+		haDevice:  conf.HADevice,
+		statsCfgs: make(map[services.PumpID]*pumpStatsSensors),
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
+	}
+
+	// build configs
+	for _, pump := range conf.Pumps {
+		h.statsCfgs[services.PumpID(pump.ID)] = h.getStatsConfig(pump)
+	}
+
+	err := h.Announce()
+	if err != nil {
+		return nil, err
+	}
+
+	// starts and timestamps change on every switch, report them immediately
+	pumpSvc.AddStateObserver(func(pumpID services.PumpID, state services.PumpState) {
+		err := h.reportPumpStats(pumpID)
+		if err != nil {
+			log.Error().Msgf("failed to report pump %d stats: %s", pumpID, err)
+		}
+	})
+
+	// runtime and energy grow while pumps are running
+	h.ticker = time.NewTicker(time.Minute)
+	go func() {
+		for range h.ticker.C {
+			for id := range h.statsCfgs {
+				err := h.reportPumpStats(id)
+				if err != nil {
+					log.Error().Msgf("failed to report pump %d stats: %s", id, err)
+				}
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// Announce sends pump stats sensor configs, availability and current values to Home Assistant
+func (obj *HAPumpStatsHandler) Announce() error {
+	for _, pump := range obj.statsCfgs {
+		for _, sensor := range pump.all() {
+			err := obj.sendConfig(sensor)
+			if err != nil {
+				return fmt.Errorf("failed to send config for sensor %s, err: %w", sensor.UniqueID, err)
+			}
+			// Home Assistant is slow sometimes while processing new configs... wait a bit
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	for _, pump := range obj.statsCfgs {
+		for _, sensor := range pump.all() {
+			token := obj.client.Publish(obj.availabilityTopic(sensor.UniqueID), 0, true, "online")
+			if !token.WaitTimeout(2 * time.Second) {
+				return fmt.Errorf("failed to update sensor %s availability, %w", sensor.UniqueID, token.Error())
+			}
+		}
+	}
+
+	for id := range obj.statsCfgs {
+		err := obj.reportPumpStats(id)
+		if err != nil {
+			return fmt.Errorf("failed to report pump %d stats, err: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the HAPumpStatsHandler and performs necessary cleanup
+func (obj *HAPumpStatsHandler) Close() error {
+	obj.ticker.Stop()
+	return nil
+}
+
+// reportPumpStats reports the current accounting of a pump to Home Assistant
+func (obj *HAPumpStatsHandler) reportPumpStats(pumpID services.PumpID) error {
+	sensors, ok := obj.statsCfgs[pumpID]
+	if !ok {
+		return nil
+	}
+	stats, err := obj.pumpsSvc.GetPumpStats(pumpID)
+	if err != nil {
+		return fmt.Errorf("failed to get pump %d stats, err: %w", pumpID, err)
+	}
+
+	msgs := map[*model.Sensor]string{
+		sensors.runtime: strconv.FormatFloat(stats.RuntimeSeconds/3600, 'f', 3, 64),
+		sensors.starts:  strconv.Itoa(stats.Starts),
+	}
+	// timestamps are unknown until the pump switches for the first time
+	if !stats.LastOn.IsZero() {
+		msgs[sensors.lastOn] = stats.LastOn.Format(time.RFC3339)
+	}
+	if !stats.LastOff.IsZero() {
+		msgs[sensors.lastOff] = stats.LastOff.Format(time.RFC3339)
+	}
+	if sensors.energy != nil {
+		msgs[sensors.energy] = strconv.FormatFloat(stats.EnergyKWh, 'f', 3, 64)
+	}
+
+	for sensor, msg := range msgs {
+		err := obj.sendFeedbackMessage(msg, sensor.StateTopic)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getStatsConfig creates configurations for the accounting sensors of a pump
+func (obj *HAPumpStatsHandler) getStatsConfig(pumpCfg *config.PumpConfig) *pumpStatsSensors {
+	uid := fmt.Sprintf("heating_pump_%d", pumpCfg.ID)
+	sensors := &pumpStatsSensors{
+		runtime: obj.getSensorConfig(uid+"_runtime", pumpCfg.Name+" Runtime"),
+		starts:  obj.getSensorConfig(uid+"_starts", pumpCfg.Name+" Starts"),
+		lastOn:  obj.getSensorConfig(uid+"_last_on", pumpCfg.Name+" Last On"),
+		lastOff: obj.getSensorConfig(uid+"_last_off", pumpCfg.Name+" Last Off"),
+	}
+	sensors.runtime.DeviceClass = "duration"
+	sensors.runtime.UnitOfMeasurement = "h"
+	sensors.runtime.StateClass = model.StateClassTotalIncreasing
+	sensors.starts.StateClass = model.StateClassTotalIncreasing
+	sensors.starts.Icon = "mdi:counter"
+	sensors.lastOn.DeviceClass = "timestamp"
+	sensors.lastOff.DeviceClass = "timestamp"
+
+	if pumpCfg.RatedWatts > 0 {
+		sensors.energy = obj.getSensorConfig(uid+"_energy", pumpCfg.Name+" Energy")
+		sensors.energy.DeviceClass = "energy"
+		sensors.energy.UnitOfMeasurement = "kWh"
+		sensors.energy.StateClass = model.StateClassTotalIncreasing
+	}
+	return sensors
+}
+
+// getSensorConfig creates a base configuration for an accounting sensor
+func (obj *HAPumpStatsHandler) getSensorConfig(uid string, name string) *model.Sensor {
+	return &model.Sensor{
+		Schema:     "json",
+		UniqueID:   uid,
+		Name:       name,
+		Device:     obj.haDevice,
+		StateTopic: fmt.Sprintf("homeassistant/sensor/%s/state", uid),
+		Availability: []*model.Availability{
+			{Topic: obj.availabilityTopic(uid)},
+			{Topic: obj.deviceAvailabilityTopic},
+		},
+		AvailabilityMode: model.AvailabilityModeAll,
+	}
+}
+
+// availabilityTopic returns the availability topic of a single sensor
+func (obj *HAPumpStatsHandler) availabilityTopic(uid string) string {
+	return fmt.Sprintf("homeassistant/sensor/%s/status", uid)
+}
+
+// sendFeedbackMessage sends feedback message to Home Assistant.
+func (obj *HAPumpStatsHandler) sendFeedbackMessage(msg string, stateTopic string) error {
+	token := obj.client.Publish(stateTopic, 0, true, msg)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("failed to send feedback message to topic %s: %w", stateTopic, token.Error())
+	}
+	return nil
+}
+
+// sendConfig sends configuration to Home Assistant for a sensor
+func (obj *HAPumpStatsHandler) sendConfig(sensor *model.Sensor) error {
+	conf, err := jsoniter.MarshalToString(sensor)
+	if err != nil {
+		return err
+	}
+	token := obj.client.Publish(fmt.Sprintf("homeassistant/sensor/%s/config", sensor.UniqueID), 0, true, conf)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("failed to send config %v: %w", sensor, token.Error())
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"fmt"
+	"rpi-heating-system/app/config"
+	"rpi-heating-system/app/services"
+	"rpi-heating-system/lib/homeassistant/model"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// safetyDeviceClasses maps safety rule kinds to Home Assistant binary sensor device classes
+var safetyDeviceClasses = map[services.SafetyRuleKind]string{
+	services.SafetyRuleOverheat: "heat",
+	services.SafetyRuleFrost:    "cold",
+}
+
+// safetyAttributes are the JSON attributes published with a safety rule
+type safetyAttributes struct {
+	Fault        bool     `json:"fault"`         // a linked sensor failed or stopped reporting, the rule is held ON
+	FaultSensors []string `json:"fault_sensors"` // sensors without a current reading
+}
+
+// HASafetyHandler is the implementation of HAController interface
+// It publishes the state of every safety rule as a Home Assistant binary sensor, ON means alarm
+// Sensor faults are published as attributes of the binary sensor
+type HASafetyHandler struct {
+	client    MQTT.Client
+	safetySvc *services.SafetyRulesService
+	haDevice  *model.Device
+	ruleCfgs  map[string]*model.BinarySensor
+
+	deviceAvailabilityTopic string
+}
+
+// NewHASafetyHandler creates a new instance of HASafetyHandler
+func NewHASafetyHandler(
+	mqttClient MQTT.Client,
+	conf *config.AppConfig,
+	safetySvc *services.SafetyRulesService,
+) (*HASafetyHandler, error) {
+
+	h := &HASafetyHandler{
+		client:    mqttClient,
+		safetySvc: safetySvc,
+		haDevice:  conf.HADevice,
+		ruleCfgs:  make(map[string]*model.BinarySensor),
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
+	}
+
+	// build configs
+	for _, rule := range safetySvc.Rules() {
+		h.ruleCfgs[rule.Key] = h.getRuleConfig(rule)
+	}
+
+	err := h.Announce()
+	if err != nil {
+		return nil, err
+	}
+
+	safetySvc.AddRuleObserver(func(rule services.SafetyRuleInfo) {
+		err := h.reportRuleState(rule)
+		if err != nil {
+			log.Error().Msgf("failed to report safety rule %s state: %s", rule.Name, err)
+		}
+	})
+
+	return h, nil
+}
+
+// Announce sends safety rule configs, availability and current states to Home Assistant
+func (obj *HASafetyHandler) Announce() error {
+	for _, rule := range obj.ruleCfgs {
+		err := obj.sendConfig(rule)
+		if err != nil {
+			return fmt.Errorf("failed to send config for safety rule %s, err: %w", rule.UniqueID, err)
+		}
+		// Home Assistant is slow sometimes while processing new configs... wait a bit
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, rule := range obj.ruleCfgs {
+		token := obj.client.Publish(obj.availabilityTopic(rule.UniqueID), 0, true, "online")
+		if !token.WaitTimeout(2 * time.Second) {
+			return fmt.Errorf("failed to update safety rule %s availability, %w", rule.UniqueID, token.Error())
+		}
+	}
+
+	for _, rule := range obj.safetySvc.Rules() {
+		err := obj.reportRuleState(rule)
+		if err != nil {
+			return fmt.Errorf("failed to report safety rule %s state, err: %w", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the HASafetyHandler and performs necessary cleanup
+func (obj *HASafetyHandler) Close() error {
+	return nil
+}
+
+// reportRuleState reports the current state of a safety rule to Home Assistant
+func (obj *HASafetyHandler) reportRuleState(rule services.SafetyRuleInfo) error {
+	cfg, ok := obj.ruleCfgs[rule.Key]
+	if !ok {
+		return fmt.Errorf("safety rule %s not found in config", rule.Key)
+	}
+	msg := "OFF"
+	if rule.Active {
+		msg = "ON"
+	}
+	err := obj.sendFeedbackMessage(msg, cfg.StateTopic)
+	if err != nil {
+		return err
+	}
+	attrs, err := jsoniter.MarshalToString(&safetyAttributes{
+		Fault:        rule.Fault,
+		FaultSensors: append([]string{}, rule.FaultSensors...),
+	})
+	if err != nil {
+		return err
+	}
+	return obj.sendFeedbackMessage(attrs, cfg.JSONAttributesTopic)
+}
+
+// getRuleConfig creates a configuration for a safety rule
+func (obj *HASafetyHandler) getRuleConfig(rule services.SafetyRuleInfo) *model.BinarySensor {
+	uid := fmt.Sprintf("safety_%s", rule.Key)
+	return &model.BinarySensor{
+		Schema:     "json",
+		Name:       rule.Name,
+		UniqueID:   uid,
+		Device:     obj.haDevice,
+		StateTopic: fmt.Sprintf("homeassistant/binary_sensor/%s/state", uid),
+		Availability: []*model.Availability{
+			{Topic: obj.availabilityTopic(uid)},
+			{Topic: obj.deviceAvailabilityTopic},
+		},
+		AvailabilityMode:    model.AvailabilityModeAll,
+		DeviceClass:         safetyDeviceClasses[rule.Kind],
+		JSONAttributesTopic: fmt.Sprintf("homeassistant/binary_sensor/%s/attributes", uid),
+	}
+}
+
+// availabilityTopic returns the availability topic of a single safety rule
+func (obj *HASafetyHandler) availabilityTopic(uid string) string {
+	return fmt.Sprintf("homeassistant/binary_sensor/%s/availability", uid)
+}
+
+// sendFeedbackMessage sends feedback message to Home Assistant.
+func (obj *HASafetyHandler) sendFeedbackMessage(msg string, stateTopic string) error {
+	token := obj.client.Publish(stateTopic, 0, true, msg)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("failed to send feedback message to topic %s: %w", stateTopic, token.Error())
+	}
+	return nil
+}
+
+// sendConfig sends configuration to Home Assistant for a safety rule
+func (obj *HASafetyHandler) sendConfig(sensor *model.BinarySensor) error {
+	conf, err := jsoniter.MarshalToString(sensor)
+	if err != nil {
+		return err
+	}
+	token := obj.client.Publish(fmt.Sprintf("homeassistant/binary_sensor/%s/config", sensor.UniqueID), 0, true, conf)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("failed to send config %v: %w", sensor, token.Error())
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"fmt"
+	"rpi-heating-system/app/config"
+	"rpi-heating-system/app/services"
+	"rpi-heating-system/lib/homeassistant/model"
+	"strconv"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// sensorErrorSensors holds the Home Assistant diagnostic sensor configs of a single temperature sensor
+type sensorErrorSensors struct {
+	crc        *model.Sensor
+	missing    *model.Sensor
+	outOfRange *model.Sensor
+}
+
+// all returns all diagnostic sensors of the temperature sensor
+func (s *sensorErrorSensors) all() []*model.Sensor {
+	return []*model.Sensor{s.crc, s.missing, s.outOfRange}
+}
+
+// HASensorDiagnosticsHandler is the implementation of HAController interface
+// It publishes read error counters of temperature sensors as Home Assistant diagnostic sensors
+type HASensorDiagnosticsHandler struct {
+	client     MQTT.Client
+	counterSvc services.SensorErrorCounter
+	haDevice   *model.Device
+	sensorCfgs map[string]*sensorErrorSensors
+	ticker     *time.Ticker
+
+	deviceAvailabilityTopic string
+}
+
+// NewHASensorDiagnosticsHandler creates a new instance of HASensorDiagnosticsHandler
+func NewHASensorDiagnosticsHandler(
+	mqttClient MQTT.Client,
+	conf *config.AppConfig,
+	counterSvc services.SensorErrorCounter,
+) (*HASensorDiagnosticsHandler, error) {
+
+	h := &HASensorDiagnosticsHandler{
+		client:     mqttClient,
+		counterSvc: counterSvc,
+		haDevice:   conf.HADevice,
+		sensorCfgs: make(map[string]*sensorErrorSensors),
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
+	}
+
+	// build configs
+	for _, sensor := range conf.TempSensors {
+		// error counters are kept for DS18B20 sensors only
+		if sensor.DriverType() != config.SensorTypeDS18B20 {
+			continue
+		}
+		h.sensorCfgs[sensor.ID] = h.getErrorsConfig(sensor)
+	}
+
+	err := h.Announce()
+	if err != nil {
+		return nil, err
+	}
+
+	h.ticker = time.NewTicker(time.Minute)
+	go func() {
+		for range h.ticker.C {
+			for id := range h.sensorCfgs {
+				err := h.reportErrorCounters(id)
+				if err != nil {
+					log.Error().Msgf("failed to report sensor %s error counters: %s", id, err)
+				}
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// Announce sends diagnostic sensor configs, availability and current counters to Home Assistant
+func (obj *HASensorDiagnosticsHandler) Announce() error {
+	for _, sensor := range obj.sensorCfgs {
+		for _, diag := range sensor.all() {
+			err := obj.sendConfig(diag)
+			if err != nil {
+				return fmt.Errorf("failed to send config for sensor %s, err: %w", diag.UniqueID, err)
+			}
+			// Home Assistant is slow sometimes while processing new configs... wait a bit
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	for _, sensor := range obj.sensorCfgs {
+		for _, diag := range sensor.all() {
+			token := obj.client.Publish(obj.availabilityTopic(diag.UniqueID), 0, true, "online")
+			if !token.WaitTimeout(2 * time.Second) {
+				return fmt.Errorf("failed to update sensor %s availability, %w", diag.UniqueID, token.Error())
+			}
+		}
+	}
+
+	for id := range obj.sensorCfgs {
+		err := obj.reportErrorCounters(id)
+		if err != nil {
+			return fmt.Errorf("failed to report sensor %s error counters, err: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the HASensorDiagnosticsHandler and performs necessary cleanup
+func (obj *HASensorDiagnosticsHandler) Close() error {
+	obj.ticker.Stop()
+	return nil
+}
+
+// reportErrorCounters reports the error counters of a temperature sensor to Home Assistant
+func (obj *HASensorDiagnosticsHandler) reportErrorCounters(id string) error {
+	sensor := obj.sensorCfgs[id]
+	counters := obj.counterSvc.ErrorCounters(id)
+	msgs := map[*model.Sensor]int{
+		sensor.crc:        counters.CRC,
+		sensor.missing:    counters.Missing,
+		sensor.outOfRange: counters.OutOfRange,
+	}
+	for diag, count := range msgs {
+		err := obj.sendFeedbackMessage(strconv.Itoa(count), diag.StateTopic)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getErrorsConfig creates configurations for the diagnostic sensors of a temperature sensor
+func (obj *HASensorDiagnosticsHandler) getErrorsConfig(cfg *config.TempSensorsConfig) *sensorErrorSensors {
+	uid := fmt.Sprintf("temp_%s", cfg.ID)
+	return &sensorErrorSensors{
+		crc:        obj.getSensorConfig(uid+"_crc_errors", cfg.Name+" CRC Errors"),
+		missing:    obj.getSensorConfig(uid+"_missing_errors", cfg.Name+" Missing Errors"),
+		outOfRange: obj.getSensorConfig(uid+"_range_errors", cfg.Name+" Out of Range Errors"),
+	}
+}
+
+// getSensorConfig creates a configuration for a diagnostic error counter
+func (obj *HASensorDiagnosticsHandler) getSensorConfig(uid string, name string) *model.Sensor {
+	return &model.Sensor{
+		Schema:     "json",
+		UniqueID:   uid,
+		Name:       name,
+		Device:     obj.haDevice,
+		StateTopic: fmt.Sprintf("homeassistant/sensor/%s/state", uid),
+		Availability: []*model.Availability{
+			{Topic: obj.availabilityTopic(uid)},
+			{Topic: obj.deviceAvailabilityTopic},
+		},
+		AvailabilityMode: model.AvailabilityModeAll,
+		StateClass:       model.StateClassTotalIncreasing,
+		EntityCategory:   model.EntityCategoryDiagnostic,
+		Icon:             "mdi:alert-circle-outline",
+	}
+}
+
+// availabilityTopic returns the availability topic of a single sensor
+func (obj *HASensorDiagnosticsHandler) availabilityTopic(uid string) string {
+	return fmt.Sprintf("homeassistant/sensor/%s/status", uid)
+}
+
+// sendFeedbackMessage sends feedback message to Home Assistant.
+func (obj *HASensorDiagnosticsHandler) sendFeedbackMessage(msg string, stateTopic string) error {
+	token := obj.client.Publish(stateTopic, 0, true, msg)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("failed to send feedback message to topic %s: %w", stateTopic, token.Error())
+	}
+	return nil
+}
+
+// sendConfig sends configuration to Home Assistant for a sensor
+func (obj *HASensorDiagnosticsHandler) sendConfig(sensor *model.Sensor) error {
+	conf, err := jsoniter.MarshalToString(sensor)
+	if err != nil {
+		return err
+	}
+	token := obj.client.Publish(fmt.Sprintf("homeassistant/sensor/%s/config", sensor.UniqueID), 0, true, conf)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("failed to send config %v: %w", sensor, token.Error())
+	}
+	return nil
+}
@@ -1,11 +1,14 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"rpi-heating-system/app/config"
 	"rpi-heating-system/app/services"
 	"rpi-heating-system/lib/homeassistant/model"
 	"strconv"
+	"sync"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
@@ -13,81 +16,170 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// defaultMaxFailedReads is the number of failed reads in a row before a sensor goes offline
+	defaultMaxFailedReads = 3
+	// defaultExpireAfter is the time in seconds after which Home Assistant expires a sensor value
+	defaultExpireAfter = 150
+	// defaultMaxSilence is the time after which an unchanged temperature is published again
+	defaultMaxSilence = 60 * time.Second
+)
+
+// publishPolicy decides which sampled temperatures of a sensor are published
+type publishPolicy struct {
+	minDelta   float64
+	maxSilence time.Duration
+}
+
 type HATemperatureSensorsHandler struct {
-	client           MQTT.Client
-	haDevice         *model.Device
-	tempSensorReader services.TempSensorReader
-	sensorCfgs       map[string]*model.TemperatureSensor
-	ticker           *time.Ticker
+	client         MQTT.Client
+	haDevice       *model.Device
+	sensorCfgs     map[string]*model.TemperatureSensor
+	rawCfgs        map[string]*model.Sensor // unfiltered value diagnostic sensors, keyed by sensor ID
+	mu             sync.Mutex
+	lastTemps      map[string]float64   // last reported temperature, keyed by sensor ID
+	lastPublished  map[string]time.Time // time of the last reported temperature, keyed by sensor ID
+	policies       map[string]publishPolicy
+	unavailable    map[string]bool // sensors currently reported as offline, keyed by sensor ID
+	failedReads    map[string]int  // failed reads in a row, keyed by sensor ID
+	maxFailedReads int
+	expireAfter    int
+
+	deviceAvailabilityTopic string
 }
 
 func NewHATemperatureSensorsHandler(
 	mqttClient MQTT.Client,
 	conf *config.AppConfig,
-	tempSensorReader services.TempSensorReader,
+	sampler *services.TempSamplerService,
 ) (*HATemperatureSensorsHandler, error) {
 	log.Debug().Msg("Creating Temp sensor HA handler")
 	h := &HATemperatureSensorsHandler{
-		client:           mqttClient,
-		tempSensorReader: tempSensorReader,
-		haDevice:         conf.HADevice,
-		sensorCfgs:       make(map[string]*model.TemperatureSensor),
+		client:         mqttClient,
+		haDevice:       conf.HADevice,
+		sensorCfgs:     make(map[string]*model.TemperatureSensor),
+		rawCfgs:        make(map[string]*model.Sensor),
+		lastTemps:      make(map[string]float64),
+		lastPublished:  make(map[string]time.Time),
+		policies:       make(map[string]publishPolicy),
+		unavailable:    make(map[string]bool),
+		failedReads:    make(map[string]int),
+		maxFailedReads: defaultMaxFailedReads,
+		expireAfter:    defaultExpireAfter,
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
+	}
+
+	if conf.TempSampling != nil {
+		if conf.TempSampling.MaxFailedReads > 0 {
+			h.maxFailedReads = conf.TempSampling.MaxFailedReads
+		}
+		if conf.TempSampling.ExpireAfter > 0 {
+			h.expireAfter = conf.TempSampling.ExpireAfter
+		}
+	}
+
+	global := publishPolicy{maxSilence: defaultMaxSilence}
+	if conf.TempSampling != nil {
+		if conf.TempSampling.MinDelta != nil {
+			global.minDelta = *conf.TempSampling.MinDelta
+		}
+		if conf.TempSampling.MaxSilence > 0 {
+			global.maxSilence = time.Duration(conf.TempSampling.MaxSilence) * time.Second
+		}
 	}
 
 	// build configs
 	for _, sensor := range conf.TempSensors {
 		sensorConf := h.getSensorConfig(sensor)
 		h.sensorCfgs[sensor.ID] = sensorConf
+		if sensor.PublishRaw {
+			h.rawCfgs[sensor.ID] = h.getRawSensorConfig(sensor, sensorConf)
+		}
+
+		policy := global
+		if sensor.MinDelta != nil {
+			policy.minDelta = *sensor.MinDelta
+		}
+		if sensor.MaxSilence > 0 {
+			policy.maxSilence = time.Duration(sensor.MaxSilence) * time.Second
+		}
+		h.policies[sensor.ID] = policy
+
+		// Home Assistant would expire values between two publishes
+		expireAfter := time.Duration(h.expireAfter) * time.Second
+		if sampler.Interval(sensor.ID) >= expireAfter || (policy.minDelta > 0 && policy.maxSilence >= expireAfter) {
+			log.Warn().Msgf("Sensor %s poll interval or max silence is not shorter than expire after %s", sensor.ID, expireAfter)
+		}
+	}
+	err := h.Announce()
+	if err != nil {
+		return nil, err
 	}
-	log.Debug().Msgf("Sending sensor configs %+v", h.sensorCfgs)
+
+	sampler.AddListener(h.onSample)
+
+	// report values sampled before the handler was created,
+	// a missing sensor must not prevent the start, it is reported as unavailable instead
+	for id := range h.sensorCfgs {
+		sample, ok := sampler.Sample(id)
+		if ok {
+			h.onSample(id, sample)
+		}
+	}
+
+	return h, nil
+}
+
+// Announce sends sensor configs, availability and last known temperatures to Home Assistant
+func (obj *HATemperatureSensorsHandler) Announce() error {
+	log.Debug().Msgf("Sending sensor configs %+v", obj.sensorCfgs)
 	// send configs
-	for _, sensor := range h.sensorCfgs {
-		err := h.sendConfig(sensor)
+	for _, sensor := range obj.sensorCfgs {
+		err := obj.sendConfig(sensor.UniqueID, sensor)
 		if err != nil {
-			return nil, fmt.Errorf("failed to send config for sensor %s, err: %w", sensor.UniqueID, err)
+			return fmt.Errorf("failed to send config for sensor %s, err: %w", sensor.UniqueID, err)
 		}
 		// Home Assistant is slow sometimes while processing new configs... wait a bit
 		time.Sleep(100 * time.Millisecond)
 	}
-
-	// set all the sensors as available
-	for _, sensor := range h.sensorCfgs {
-		token := h.client.Publish(sensor.AvailabilityTopic, 0, true, "online")
-		if !token.WaitTimeout(2 * time.Second) {
-			return nil, fmt.Errorf("failed to update sensor %s availability, %w", sensor.UniqueID, token.Error())
+	for _, sensor := range obj.rawCfgs {
+		err := obj.sendConfig(sensor.UniqueID, sensor)
+		if err != nil {
+			return fmt.Errorf("failed to send config for sensor %s, err: %w", sensor.UniqueID, err)
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
 
-	for id, sensor := range h.sensorCfgs {
-		err := h.reportSensorTemperature(id, sensor)
+	// set sensors availability, missing sensors stay offline
+	for id, sensor := range obj.sensorCfgs {
+		obj.mu.Lock()
+		available := !obj.unavailable[id]
+		obj.mu.Unlock()
+		err := obj.sendAvailability(sensor, available)
 		if err != nil {
-			return nil, fmt.Errorf("failed to report sensor %s temperature, err: %w", sensor.UniqueID, err)
+			return err
 		}
 	}
 
-	ticker := time.NewTicker(30 * time.Second)
-	// Create a goroutine to read sensor values periodically
-	go func() {
-		for range ticker.C {
-			// Report sensor state
-			for id, sensor := range h.sensorCfgs {
-				err := h.reportSensorTemperature(id, sensor)
-				if err != nil {
-					log.Error().Msgf("failed to report sensor %s temperature: %s", sensor.UniqueID, err)
-				}
-			}
+	// replay last known temperatures
+	obj.mu.Lock()
+	temps := make(map[string]float64, len(obj.lastTemps))
+	for id, temp := range obj.lastTemps {
+		temps[id] = temp
+	}
+	obj.mu.Unlock()
+	for id, temp := range temps {
+		err := obj.sendFeedbackMessage(strconv.FormatFloat(temp, 'f', 2, 64), obj.sensorCfgs[id].StateTopic)
+		if err != nil {
+			return fmt.Errorf("failed to report sensor %s temperature, err: %w", obj.sensorCfgs[id].UniqueID, err)
 		}
-	}()
-
-	// Store the ticker in the struct to be able to stop it later
-	h.ticker = ticker
-
-	return h, nil
+	}
+	return nil
 }
 
 // Close closes the HATemperatureSensorsHandler and performs necessary cleanup
 func (obj *HATemperatureSensorsHandler) Close() error {
-	obj.ticker.Stop()
 	return nil
 }
 
@@ -95,25 +187,140 @@ func (obj *HATemperatureSensorsHandler) Close() error {
 func (obj *HATemperatureSensorsHandler) getSensorConfig(cfg *config.TempSensorsConfig) *model.TemperatureSensor {
 	uid := fmt.Sprintf("temp_%s", cfg.ID)
 	return &model.TemperatureSensor{
+		Schema:     "json",
+		UniqueID:   uid,
+		Name:       cfg.Name,
+		Device:     obj.haDevice,
+		StateTopic: fmt.Sprintf("homeassistant/sensor/%s/state", uid),
+		Availability: []*model.Availability{
+			{Topic: obj.availabilityTopic(uid)},
+			{Topic: obj.deviceAvailabilityTopic},
+		},
+		AvailabilityMode:  model.AvailabilityModeAll,
+		UnitOfMeasurement: "°C",
+		ExpireAfter:       obj.expireAfter,
+	}
+}
+
+// getRawSensorConfig creates a configuration for the unfiltered value of a sensor
+// It shares the availability of the filtered sensor
+func (obj *HATemperatureSensorsHandler) getRawSensorConfig(cfg *config.TempSensorsConfig, filtered *model.TemperatureSensor) *model.Sensor {
+	uid := fmt.Sprintf("temp_%s_raw", cfg.ID)
+	return &model.Sensor{
 		Schema:            "json",
 		UniqueID:          uid,
-		Name:              cfg.Name,
+		Name:              cfg.Name + " Raw",
 		Device:            obj.haDevice,
 		StateTopic:        fmt.Sprintf("homeassistant/sensor/%s/state", uid),
-		AvailabilityTopic: fmt.Sprintf("homeassistant/sensor/%s/status", uid),
+		Availability:      filtered.Availability,
+		AvailabilityMode:  model.AvailabilityModeAll,
+		DeviceClass:       "temperature",
+		StateClass:        model.StateClassMeasurement,
 		UnitOfMeasurement: "°C",
+		EntityCategory:    model.EntityCategoryDiagnostic,
+	}
+}
+
+// availabilityTopic returns the availability topic of a single sensor
+func (obj *HATemperatureSensorsHandler) availabilityTopic(uid string) string {
+	return fmt.Sprintf("homeassistant/sensor/%s/status", uid)
+}
+
+// onSample is called by the sampler after every read of a sensor
+func (obj *HATemperatureSensorsHandler) onSample(ID string, sample services.TempSample) {
+	sensor, ok := obj.sensorCfgs[ID]
+	if !ok {
+		return
+	}
+	err := obj.reportSensorTemperature(ID, sensor, sample)
+	if err != nil {
+		log.Error().Msgf("failed to report sensor %s temperature: %s", sensor.UniqueID, err)
 	}
 }
 
-func (obj *HATemperatureSensorsHandler) reportSensorTemperature(ID string, sensor *model.TemperatureSensor) error {
-	temp, err := obj.tempSensorReader.Read(ID)
+// reportSensorTemperature reports a sampled temperature to Home Assistant and tracks the sensor availability
+func (obj *HATemperatureSensorsHandler) reportSensorTemperature(ID string, sensor *model.TemperatureSensor, sample services.TempSample) error {
+	err := sample.Err
 	if err != nil {
+		obj.mu.Lock()
+		obj.failedReads[ID]++
+		failed := obj.failedReads[ID]
+		obj.mu.Unlock()
+		// a sensor missing on the bus will not come back by retrying, report it right away
+		if failed >= obj.maxFailedReads || errors.Is(err, services.ErrSensorNotFound) {
+			obj.setAvailability(ID, sensor, false)
+		}
 		return fmt.Errorf("failed to read temperature for sensor %s, err: %w", ID, err)
 	}
+	obj.mu.Lock()
+	obj.failedReads[ID] = 0
+	obj.mu.Unlock()
+	obj.setAvailability(ID, sensor, true)
+	if raw, ok := obj.rawCfgs[ID]; ok {
+		err := obj.sendFeedbackMessage(strconv.FormatFloat(sample.Raw, 'f', 2, 64), raw.StateTopic)
+		if err != nil {
+			log.Error().Msgf("failed to report sensor %s raw temperature: %s", raw.UniqueID, err)
+		}
+	}
+	temp := sample.Temp
+
+	obj.mu.Lock()
+	if !obj.shouldPublish(ID, temp) {
+		obj.mu.Unlock()
+		return nil
+	}
+	obj.lastTemps[ID] = temp
+	obj.lastPublished[ID] = time.Now()
+	obj.mu.Unlock()
 	log.Debug().Msgf("Reporting temperature for sensor %s, temp %f[]", ID, temp)
 	return obj.sendFeedbackMessage(strconv.FormatFloat(temp, 'f', 2, 64), sensor.StateTopic)
 }
 
+// shouldPublish reports whether the temperature changed enough or the sensor was silent for too long
+// It must be called with obj.mu held
+func (obj *HATemperatureSensorsHandler) shouldPublish(ID string, temp float64) bool {
+	last, ok := obj.lastTemps[ID]
+	if !ok {
+		return true
+	}
+	policy := obj.policies[ID]
+	return math.Abs(temp-last) >= policy.minDelta || time.Since(obj.lastPublished[ID]) >= policy.maxSilence
+}
+
+// setAvailability reports the sensor availability to Home Assistant if it has changed
+func (obj *HATemperatureSensorsHandler) setAvailability(ID string, sensor *model.TemperatureSensor, available bool) {
+	obj.mu.Lock()
+	changed := obj.unavailable[ID] == available
+	obj.unavailable[ID] = !available
+	obj.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	if available {
+		log.Info().Msgf("Sensor %s is available again", ID)
+	} else {
+		log.Warn().Msgf("Sensor %s is unavailable", ID)
+	}
+	err := obj.sendAvailability(sensor, available)
+	if err != nil {
+		log.Error().Msgf("failed to update sensor %s availability: %s", sensor.UniqueID, err)
+	}
+}
+
+// sendAvailability publishes the sensor availability to Home Assistant
+func (obj *HATemperatureSensorsHandler) sendAvailability(sensor *model.TemperatureSensor, available bool) error {
+	msg := "online"
+	if !available {
+		msg = "offline"
+	}
+	token := obj.client.Publish(obj.availabilityTopic(sensor.UniqueID), 0, true, msg)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("failed to update sensor %s availability, %w", sensor.UniqueID, token.Error())
+	}
+	return nil
+}
+
 // sendFeedbackMessage sends feedback message to Home Assistant.
 func (obj *HATemperatureSensorsHandler) sendFeedbackMessage(msg string, stateTopic string) error {
 	token := obj.client.Publish(stateTopic, 0, true, msg)
@@ -124,12 +331,12 @@ func (obj *HATemperatureSensorsHandler) sendFeedbackMessage(msg string, stateTop
 }
 
 // sendConfig sends configuration to Home Assistant for a sensor
-func (obj *HATemperatureSensorsHandler) sendConfig(sensor *model.TemperatureSensor) error {
+func (obj *HATemperatureSensorsHandler) sendConfig(uid string, sensor any) error {
 	conf, err := jsoniter.MarshalToString(sensor)
 	if err != nil {
 		return err
 	}
-	token := obj.client.Publish(fmt.Sprintf("homeassistant/sensor/%s/config", sensor.UniqueID), 0, true, conf)
+	token := obj.client.Publish(fmt.Sprintf("homeassistant/sensor/%s/config", uid), 0, true, conf)
 	if !token.WaitTimeout(10 * time.Second) {
 		return fmt.Errorf("failed to send config %v: %w", sensor, token.Error())
 	}
@@ -0,0 +1,252 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"rpi-heating-system/app/config"
+	"rpi-heating-system/app/services"
+	"rpi-heating-system/lib/homeassistant/model"
+	"strconv"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// trendSensors holds the Home Assistant entity configs of a single trend
+type trendSensors struct {
+	rate     *model.Sensor
+	activity *model.BinarySensor // nil if the trend has no activity
+}
+
+// HATrendHandler is the implementation of HAController interface
+// It publishes the rate of change of sensors and the activities driven by it to Home Assistant
+// Trends without enough history are reported unavailable, so retained values do not outlive a failed sensor
+type HATrendHandler struct {
+	client    MQTT.Client
+	trendSvc  *services.TrendService
+	haDevice  *model.Device
+	trendCfgs map[int]*trendSensors
+	ticker    *time.Ticker
+	mu        sync.Mutex
+	online    map[int]bool // trends reported available, keyed by trend ID
+
+	deviceAvailabilityTopic string
+}
+
+// NewHATrendHandler creates a new instance of HATrendHandler
+func NewHATrendHandler(
+	mqttClient MQTT.Client,
+	conf *config.AppConfig,
+	trendSvc *services.TrendService,
+) (*HATrendHandler, error) {
+
+	h := &HATrendHandler{
+		client:    mqttClient,
+		trendSvc:  trendSvc,
+		haDevice:  conf.HADevice,
+		trendCfgs: make(map[int]*trendSensors),
+		online:    make(map[int]bool),
+
+		deviceAvailabilityTopic: conf.Mqtt.DeviceAvailabilityTopic(),
+	}
+
+	// build configs
+	for _, trend := range conf.Trends {
+		h.trendCfgs[trend.ID] = h.getTrendConfig(trend)
+	}
+
+	err := h.Announce()
+	if err != nil {
+		return nil, err
+	}
+
+	h.ticker = time.NewTicker(30 * time.Second)
+	go func() {
+		for range h.ticker.C {
+			for id := range h.trendCfgs {
+				err := h.reportTrend(id)
+				if err != nil {
+					log.Error().Msgf("failed to report trend %d: %s", id, err)
+				}
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// Announce sends trend entity configs, availability and current values to Home Assistant
+func (obj *HATrendHandler) Announce() error {
+	for _, trend := range obj.trendCfgs {
+		err := obj.sendConfig("sensor", trend.rate.UniqueID, trend.rate)
+		if err != nil {
+			return fmt.Errorf("failed to send config for sensor %s, err: %w", trend.rate.UniqueID, err)
+		}
+		// Home Assistant is slow sometimes while processing new configs... wait a bit
+		time.Sleep(100 * time.Millisecond)
+		if trend.activity == nil {
+			continue
+		}
+		err = obj.sendConfig("binary_sensor", trend.activity.UniqueID, trend.activity)
+		if err != nil {
+			return fmt.Errorf("failed to send config for binary sensor %s, err: %w", trend.activity.UniqueID, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for id := range obj.trendCfgs {
+		obj.mu.Lock()
+		online := obj.online[id]
+		obj.mu.Unlock()
+		err := obj.publishAvailability(id, online)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the history is empty right after the start, the trends stay unavailable until the ticker reports them
+	for id := range obj.trendCfgs {
+		err := obj.reportTrend(id)
+		if err != nil {
+			log.Error().Msgf("failed to report trend %d: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the HATrendHandler and performs necessary cleanup
+func (obj *HATrendHandler) Close() error {
+	obj.ticker.Stop()
+	return nil
+}
+
+// reportTrend calculates the trend and reports it to Home Assistant
+func (obj *HATrendHandler) reportTrend(id int) error {
+	trend := obj.trendCfgs[id]
+	reading, err := obj.trendSvc.Calculate(id)
+	if errors.Is(err, services.ErrNotEnoughHistory) {
+		return obj.setAvailable(id, false)
+	}
+	if err != nil {
+		return err
+	}
+	err = obj.sendFeedbackMessage(strconv.FormatFloat(reading.RatePerMinute, 'f', 2, 64), trend.rate.StateTopic)
+	if err != nil {
+		return err
+	}
+	if trend.activity != nil {
+		msg := "OFF"
+		if reading.Active {
+			msg = "ON"
+		}
+		err = obj.sendFeedbackMessage(msg, trend.activity.StateTopic)
+		if err != nil {
+			return err
+		}
+	}
+	return obj.setAvailable(id, true)
+}
+
+// setAvailable reports the trend entities available or unavailable if that changed
+func (obj *HATrendHandler) setAvailable(id int, available bool) error {
+	obj.mu.Lock()
+	changed := obj.online[id] != available
+	obj.online[id] = available
+	obj.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	if !available {
+		log.Warn().Msgf("Trend %d has not enough history, reporting it unavailable", id)
+	}
+	return obj.publishAvailability(id, available)
+}
+
+// publishAvailability publishes the availability of all entities of the trend
+func (obj *HATrendHandler) publishAvailability(id int, available bool) error {
+	trend := obj.trendCfgs[id]
+	topics := []string{obj.availabilityTopic("sensor", trend.rate.UniqueID)}
+	if trend.activity != nil {
+		topics = append(topics, obj.availabilityTopic("binary_sensor", trend.activity.UniqueID))
+	}
+	msg := "offline"
+	if available {
+		msg = "online"
+	}
+	for _, topic := range topics {
+		token := obj.client.Publish(topic, 0, true, msg)
+		if !token.WaitTimeout(2 * time.Second) {
+			return fmt.Errorf("failed to update availability on %s, %w", topic, token.Error())
+		}
+	}
+	return nil
+}
+
+// getTrendConfig creates configurations for the entities of a trend
+func (obj *HATrendHandler) getTrendConfig(cfg *config.TrendConfig) *trendSensors {
+	uid := fmt.Sprintf("trend_%d", cfg.ID)
+	sensors := &trendSensors{
+		rate: &model.Sensor{
+			Schema:     "json",
+			UniqueID:   uid,
+			Name:       cfg.Name,
+			Device:     obj.haDevice,
+			StateTopic: fmt.Sprintf("homeassistant/sensor/%s/state", uid),
+			Availability: []*model.Availability{
+				{Topic: obj.availabilityTopic("sensor", uid)},
+				{Topic: obj.deviceAvailabilityTopic},
+			},
+			AvailabilityMode:  model.AvailabilityModeAll,
+			StateClass:        model.StateClassMeasurement,
+			UnitOfMeasurement: "°C/min",
+			Icon:              "mdi:chart-line-variant",
+		},
+	}
+	if cfg.Activity != nil {
+		activityUID := uid + "_activity"
+		sensors.activity = &model.BinarySensor{
+			Schema:     "json",
+			UniqueID:   activityUID,
+			Name:       cfg.Activity.Name,
+			Device:     obj.haDevice,
+			StateTopic: fmt.Sprintf("homeassistant/binary_sensor/%s/state", activityUID),
+			Availability: []*model.Availability{
+				{Topic: obj.availabilityTopic("binary_sensor", activityUID)},
+				{Topic: obj.deviceAvailabilityTopic},
+			},
+			AvailabilityMode: model.AvailabilityModeAll,
+			Icon:             "mdi:fire",
+		}
+	}
+	return sensors
+}
+
+// availabilityTopic returns the availability topic of a single entity
+func (obj *HATrendHandler) availabilityTopic(component string, uid string) string {
+	return fmt.Sprintf("homeassistant/%s/%s/status", component, uid)
+}
+
+// sendFeedbackMessage sends feedback message to Home Assistant.
+func (obj *HATrendHandler) sendFeedbackMessage(msg string, stateTopic string) error {
+	token := obj.client.Publish(stateTopic, 0, true, msg)
+	if !token.WaitTimeout(2 * time.Second) {
+		return fmt.Errorf("failed to send feedback message to topic %s: %w", stateTopic, token.Error())
+	}
+	return nil
+}
+
+// sendConfig sends configuration to Home Assistant for an entity of the component
+func (obj *HATrendHandler) sendConfig(component string, uid string, entity any) error {
+	conf, err := jsoniter.MarshalToString(entity)
+	if err != nil {
+		return err
+	}
+	token := obj.client.Publish(fmt.Sprintf("homeassistant/%s/%s/config", component, uid), 0, true, conf)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("failed to send config %v: %w", entity, token.Error())
+	}
+	return nil
+}
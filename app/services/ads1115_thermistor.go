@@ -0,0 +1,133 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"rpi-heating-system/app/config"
+	"time"
+)
+
+const (
+	// ads1115 registers
+	ads1115RegConversion = 0x00
+	ads1115RegConfig     = 0x01
+
+	// ads1115 config: start single conversion, ±4.096 V range, single-shot mode,
+	// 128 samples per second, comparator disabled
+	ads1115StartSingle = 0x8000
+	ads1115MuxSingle   = 0x4000 // AIN0 to GND, AINx adds x<<12
+	ads1115FSR4V       = 0x0200
+	ads1115SingleShot  = 0x0100
+	ads1115Rate128     = 0x0080
+	ads1115CompDisable = 0x0003
+	ads1115FullScale   = 4.096
+
+	defaultADS1115Address = 0x48
+	kelvinOffset          = 273.15
+)
+
+// thermistorDriver reads an NTC thermistor voltage divider through an ADS1115 ADC on i2c-dev
+type thermistorDriver struct {
+	conn    i2cConn
+	lockKey string
+	device  string
+	channel int
+	cfg     config.ThermistorConfig
+}
+
+// newThermistorDriver creates an ADS1115 thermistor driver from the sensor config
+func newThermistorDriver(sensor *config.TempSensorsConfig) (TempDriver, error) {
+	cfg := config.ThermistorConfig{}
+	if sensor.Thermistor != nil {
+		cfg = *sensor.Thermistor
+	}
+	if cfg.Address == 0 {
+		cfg.Address = defaultADS1115Address
+	}
+	conn, err := openI2C(sensor.Device, cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	return newThermistor(conn, sensor.Device, cfg)
+}
+
+// newThermistor creates an ADS1115 thermistor driver on an open connection
+func newThermistor(conn i2cConn, device string, cfg config.ThermistorConfig) (*thermistorDriver, error) {
+	if cfg.Channel < 0 || cfg.Channel > 3 {
+		conn.Close()
+		return nil, fmt.Errorf("ads1115 on %s: channel %d does not exist", device, cfg.Channel)
+	}
+	if cfg.SupplyVoltage == 0 {
+		cfg.SupplyVoltage = 3.3
+	}
+	if cfg.SeriesResistor == 0 {
+		cfg.SeriesResistor = 10000
+	}
+	if cfg.NominalResistance == 0 {
+		cfg.NominalResistance = 10000
+	}
+	if cfg.NominalTemp == 0 {
+		cfg.NominalTemp = 25
+	}
+	if cfg.Beta == 0 {
+		cfg.Beta = 3950
+	}
+	return &thermistorDriver{
+		conn:    conn,
+		lockKey: fmt.Sprintf("%s@0x%02x", device, cfg.Address),
+		device:  device,
+		channel: cfg.Channel,
+		cfg:     cfg,
+	}, nil
+}
+
+// Read converts the divider voltage of the channel and returns the thermistor temperature in °C
+func (obj *thermistorDriver) Read() (float64, error) {
+	voltage, err := obj.readVoltage()
+	if err != nil {
+		return 0.0, err
+	}
+	// an open thermistor pulls the input to the supply, a shorted one to ground
+	if voltage <= 0 || voltage >= obj.cfg.SupplyVoltage {
+		return 0.0, fmt.Errorf("ads1115 on %s channel %d voltage %.3f V, thermistor open or shorted: %w",
+			obj.device, obj.channel, voltage, ErrOutOfRange)
+	}
+	resistance := obj.cfg.SeriesResistor * voltage / (obj.cfg.SupplyVoltage - voltage)
+	// Beta equation: 1/T = 1/T0 + ln(R/R0)/B
+	inv := 1/(obj.cfg.NominalTemp+kelvinOffset) + math.Log(resistance/obj.cfg.NominalResistance)/obj.cfg.Beta
+	return 1/inv - kelvinOffset, nil
+}
+
+// Close closes the I2C device
+func (obj *thermistorDriver) Close() error {
+	return obj.conn.Close()
+}
+
+// readVoltage runs a single-shot conversion of the channel
+// The ADC is shared by up to four sensors, the conversion must not be interleaved
+func (obj *thermistorDriver) readVoltage() (float64, error) {
+	lock := deviceLock(obj.lockKey)
+	lock.Lock()
+	defer lock.Unlock()
+
+	cfg := uint16(ads1115StartSingle | ads1115MuxSingle | obj.channel<<12 |
+		ads1115FSR4V | ads1115SingleShot | ads1115Rate128 | ads1115CompDisable)
+	err := obj.conn.Write([]byte{ads1115RegConfig, byte(cfg >> 8), byte(cfg)})
+	if err != nil {
+		return 0.0, fmt.Errorf("failed to start ads1115 conversion on %s: %w", obj.device, err)
+	}
+	// a conversion at 128 SPS takes 7.8 ms
+	time.Sleep(10 * time.Millisecond)
+
+	err = obj.conn.Write([]byte{ads1115RegConversion})
+	if err != nil {
+		return 0.0, fmt.Errorf("failed to select ads1115 conversion register on %s: %w", obj.device, err)
+	}
+	data := make([]byte, 2)
+	err = obj.conn.Read(data)
+	if err != nil {
+		return 0.0, fmt.Errorf("failed to read ads1115 conversion on %s: %w", obj.device, err)
+	}
+	raw := int16(uint16(data[0])<<8 | uint16(data[1]))
+	return float64(raw) * ads1115FullScale / 32768, nil
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"errors"
+	"math"
+	"rpi-heating-system/app/config"
+	"testing"
+)
+
+// fakeI2C is an i2cConn emulating a chip with 8 bit register addresses
+// The first written byte selects the register, the following bytes are stored starting at it
+type fakeI2C struct {
+	regs   [256]byte
+	ptr    int
+	writes [][]byte
+	closed bool
+}
+
+func (obj *fakeI2C) Write(data []byte) error {
+	obj.writes = append(obj.writes, append([]byte(nil), data...))
+	obj.ptr = int(data[0])
+	copy(obj.regs[obj.ptr:], data[1:])
+	return nil
+}
+
+func (obj *fakeI2C) Read(data []byte) error {
+	copy(data, obj.regs[obj.ptr:])
+	return nil
+}
+
+func (obj *fakeI2C) Close() error {
+	obj.closed = true
+	return nil
+}
+
+// adsConn is a fake ADS1115 whose conversion register holds a fixed raw value
+type adsConn struct {
+	fakeI2C
+	raw uint16
+}
+
+func (obj *adsConn) Read(data []byte) error {
+	data[0] = byte(obj.raw >> 8)
+	data[1] = byte(obj.raw)
+	return nil
+}
+
+// thermistorVoltage returns the divider voltage of a Beta thermistor at the temperature
+func thermistorVoltage(cfg config.ThermistorConfig, temp float64) float64 {
+	t0 := cfg.NominalTemp + kelvinOffset
+	r := cfg.NominalResistance * math.Exp(cfg.Beta*(1/(temp+kelvinOffset)-1/t0))
+	return cfg.SupplyVoltage * r / (r + cfg.SeriesResistor)
+}
+
+func TestThermistorRead(t *testing.T) {
+	cfg := config.ThermistorConfig{
+		Channel:           2,
+		SupplyVoltage:     3.3,
+		SeriesResistor:    10000,
+		NominalResistance: 10000,
+		NominalTemp:       25,
+		Beta:              3950,
+	}
+	tests := []struct {
+		name    string
+		voltage float64
+		temp    float64
+	}{
+		{"nominal temperature at half supply", 1.65, 25},
+		{"freezing", thermistorVoltage(cfg, 0), 0},
+		{"hot water", thermistorVoltage(cfg, 80), 80},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &adsConn{raw: uint16(math.Round(tt.voltage / ads1115FullScale * 32768))}
+			d, err := newThermistor(conn, "i2c-test", cfg)
+			if err != nil {
+				t.Fatalf("newThermistor: %s", err)
+			}
+			temp, err := d.Read()
+			if err != nil {
+				t.Fatalf("Read: %s", err)
+			}
+			if math.Abs(temp-tt.temp) > 0.05 {
+				t.Errorf("temperature = %.3f °C, want %.3f °C", temp, tt.temp)
+			}
+
+			// single-shot conversion of AIN2 against GND, then the conversion register is selected
+			if len(conn.writes) != 2 {
+				t.Fatalf("writes = %x, want config and register select", conn.writes)
+			}
+			if want := []byte{ads1115RegConfig, 0xE3, 0x83}; string(conn.writes[0]) != string(want) {
+				t.Errorf("config write = %x, want %x", conn.writes[0], want)
+			}
+			if want := []byte{ads1115RegConversion}; string(conn.writes[1]) != string(want) {
+				t.Errorf("register select = %x, want %x", conn.writes[1], want)
+			}
+		})
+	}
+}
+
+func TestThermistorOpenOrShorted(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  uint16
+	}{
+		{"shorted", 0},
+		{"negative", 0xFFF0},
+		{"open", 0x7FFF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newThermistor(&adsConn{raw: tt.raw}, "i2c-test", config.ThermistorConfig{})
+			if err != nil {
+				t.Fatalf("newThermistor: %s", err)
+			}
+			_, err = d.Read()
+			if !errors.Is(err, ErrOutOfRange) {
+				t.Errorf("Read error = %v, want ErrOutOfRange", err)
+			}
+		})
+	}
+}
+
+func TestThermistorInvalidChannel(t *testing.T) {
+	conn := &adsConn{}
+	_, err := newThermistor(conn, "i2c-test", config.ThermistorConfig{Channel: 4})
+	if err == nil {
+		t.Fatal("newThermistor accepted channel 4")
+	}
+	if !conn.closed {
+		t.Error("connection was not closed")
+	}
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"rpi-heating-system/app/config"
+	"time"
+)
+
+const (
+	// bme280 registers
+	bme280RegCalib1   = 0x88 // 26 bytes, temperature, pressure and first humidity coefficients
+	bme280RegChipID   = 0xD0
+	bme280RegCalib2   = 0xE1 // 7 bytes, remaining humidity coefficients
+	bme280RegCtrlHum  = 0xF2
+	bme280RegStatus   = 0xF3
+	bme280RegCtrlMeas = 0xF4
+	bme280RegData     = 0xF7 // 8 bytes, pressure, temperature and humidity
+
+	bme280ChipID = 0x60
+	// ctrl_meas: temperature and pressure oversampling x1, forced mode
+	bme280ForcedX1 = 0x25
+	// ctrl_hum: humidity oversampling x1
+	bme280HumX1     = 0x01
+	bme280Measuring = 0x08
+
+	defaultBME280Address = 0x76
+)
+
+// bme280Calibration holds the factory trimming parameters of a BME280
+type bme280Calibration struct {
+	t1 uint16
+	t2 int16
+	t3 int16
+	h1 uint8
+	h2 int16
+	h3 uint8
+	h4 int16
+	h5 int16
+	h6 int8
+}
+
+// bme280Driver reads temperature and humidity of a BME280 on i2c-dev
+type bme280Driver struct {
+	conn    i2cConn
+	lockKey string
+	device  string
+	calib   bme280Calibration
+}
+
+// newBME280Driver creates a BME280 driver from the sensor config
+func newBME280Driver(sensor *config.TempSensorsConfig) (TempDriver, error) {
+	addr := uint16(defaultBME280Address)
+	if sensor.BME280 != nil && sensor.BME280.Address != 0 {
+		addr = sensor.BME280.Address
+	}
+	conn, err := openI2C(sensor.Device, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newBME280(conn, sensor.Device, addr)
+}
+
+// newBME280 checks the chip ID and loads the calibration of a BME280 on an open connection
+func newBME280(conn i2cConn, device string, addr uint16) (*bme280Driver, error) {
+	d := &bme280Driver{
+		conn:    conn,
+		lockKey: fmt.Sprintf("%s@0x%02x", device, addr),
+		device:  device,
+	}
+	id, err := d.readRegisters(bme280RegChipID, 1)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if id[0] != bme280ChipID {
+		conn.Close()
+		return nil, fmt.Errorf("bme280 on %s: unexpected chip id 0x%02x", device, id[0])
+	}
+	err = d.loadCalibration()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Read returns the temperature in °C
+func (obj *bme280Driver) Read() (float64, error) {
+	temp, _, err := obj.measure()
+	return temp, err
+}
+
+// ReadHumidity returns the relative humidity in %
+func (obj *bme280Driver) ReadHumidity() (float64, error) {
+	_, humidity, err := obj.measure()
+	return humidity, err
+}
+
+// Close closes the I2C device
+func (obj *bme280Driver) Close() error {
+	return obj.conn.Close()
+}
+
+// measure runs a forced measurement and returns the compensated temperature and humidity
+func (obj *bme280Driver) measure() (float64, float64, error) {
+	lock := deviceLock(obj.lockKey)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// ctrl_hum takes effect only after a write to ctrl_meas
+	err := obj.conn.Write([]byte{bme280RegCtrlHum, bme280HumX1})
+	if err == nil {
+		err = obj.conn.Write([]byte{bme280RegCtrlMeas, bme280ForcedX1})
+	}
+	if err != nil {
+		return 0.0, 0.0, fmt.Errorf("failed to start bme280 measurement on %s: %w", obj.device, err)
+	}
+
+	// a measurement with x1 oversampling takes at most 9.3 ms
+	measuring := true
+	for i := 0; i < 5 && measuring; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status, err := obj.readRegisters(bme280RegStatus, 1)
+		if err != nil {
+			return 0.0, 0.0, err
+		}
+		measuring = status[0]&bme280Measuring != 0
+	}
+	if measuring {
+		return 0.0, 0.0, fmt.Errorf("bme280 on %s measurement did not finish", obj.device)
+	}
+
+	data, err := obj.readRegisters(bme280RegData, 8)
+	if err != nil {
+		return 0.0, 0.0, err
+	}
+	adcT := int32(data[3])<<12 | int32(data[4])<<4 | int32(data[5])>>4
+	adcH := int32(data[6])<<8 | int32(data[7])
+	// 0x80000 is the value of a skipped temperature measurement
+	if adcT == 0x80000 {
+		return 0.0, 0.0, errors.New("bme280 temperature measurement skipped")
+	}
+	temp, tFine := obj.compensateTemp(adcT)
+	return temp, obj.compensateHumidity(adcH, tFine), nil
+}
+
+// compensateTemp converts the raw temperature with the floating point formula of the datasheet
+func (obj *bme280Driver) compensateTemp(adc int32) (float64, float64) {
+	c := obj.calib
+	var1 := (float64(adc)/16384 - float64(c.t1)/1024) * float64(c.t2)
+	var2 := float64(adc)/131072 - float64(c.t1)/8192
+	var2 = var2 * var2 * float64(c.t3)
+	tFine := var1 + var2
+	return tFine / 5120, tFine
+}
+
+// compensateHumidity converts the raw humidity with the floating point formula of the datasheet
+func (obj *bme280Driver) compensateHumidity(adc int32, tFine float64) float64 {
+	c := obj.calib
+	h := tFine - 76800
+	h = (float64(adc) - (float64(c.h4)*64 + float64(c.h5)/16384*h)) *
+		(float64(c.h2) / 65536 * (1 + float64(c.h6)/67108864*h*(1+float64(c.h3)/67108864*h)))
+	h = h * (1 - float64(c.h1)*h/524288)
+	if h > 100 {
+		return 100
+	}
+	if h < 0 {
+		return 0
+	}
+	return h
+}
+
+// loadCalibration reads the factory trimming parameters
+func (obj *bme280Driver) loadCalibration() error {
+	b1, err := obj.readRegisters(bme280RegCalib1, 26)
+	if err != nil {
+		return err
+	}
+	b2, err := obj.readRegisters(bme280RegCalib2, 7)
+	if err != nil {
+		return err
+	}
+	le16 := func(b []byte) uint16 { return uint16(b[0]) | uint16(b[1])<<8 }
+	obj.calib = bme280Calibration{
+		t1: le16(b1[0:]),
+		t2: int16(le16(b1[2:])),
+		t3: int16(le16(b1[4:])),
+		h1: b1[25],
+		h2: int16(le16(b2[0:])),
+		h3: b2[2],
+		h4: int16(int8(b2[3]))<<4 | int16(b2[4]&0x0F),
+		h5: int16(int8(b2[5]))<<4 | int16(b2[4]>>4),
+		h6: int8(b2[6]),
+	}
+	return nil
+}
+
+// readRegisters reads n consecutive registers starting at reg
+func (obj *bme280Driver) readRegisters(reg byte, n int) ([]byte, error) {
+	err := obj.conn.Write([]byte{reg})
+	if err != nil {
+		return nil, fmt.Errorf("failed to select bme280 register 0x%02x on %s: %w", reg, obj.device, err)
+	}
+	data := make([]byte, n)
+	err = obj.conn.Read(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bme280 register 0x%02x on %s: %w", reg, obj.device, err)
+	}
+	return data, nil
+}
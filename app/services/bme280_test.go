@@ -0,0 +1,149 @@
+package services
+
+import (
+	"math"
+	"testing"
+)
+
+// bme280Sample holds the trimming parameters and raw readings loaded into a fake BME280
+type bme280Sample struct {
+	calib bme280Calibration
+	adcT  int32
+	adcH  int32
+}
+
+// newFakeBME280 returns a fake BME280 register file holding the sample
+func newFakeBME280(s bme280Sample) *fakeI2C {
+	conn := &fakeI2C{}
+	r := conn.regs[:]
+	r[bme280RegChipID] = bme280ChipID
+
+	le16 := func(b []byte, v uint16) {
+		b[0] = byte(v)
+		b[1] = byte(v >> 8)
+	}
+	c := s.calib
+	le16(r[bme280RegCalib1:], c.t1)
+	le16(r[bme280RegCalib1+2:], uint16(c.t2))
+	le16(r[bme280RegCalib1+4:], uint16(c.t3))
+	r[bme280RegCalib1+25] = c.h1
+	le16(r[bme280RegCalib2:], uint16(c.h2))
+	r[bme280RegCalib2+2] = c.h3
+	// h4 and h5 are 12 bit values sharing the nibbles of one register
+	r[bme280RegCalib2+3] = byte(c.h4 >> 4)
+	r[bme280RegCalib2+4] = byte(c.h4&0x0F) | byte(c.h5&0x0F)<<4
+	r[bme280RegCalib2+5] = byte(c.h5 >> 4)
+	r[bme280RegCalib2+6] = byte(c.h6)
+
+	r[bme280RegData+3] = byte(s.adcT >> 12)
+	r[bme280RegData+4] = byte(s.adcT >> 4)
+	r[bme280RegData+5] = byte(s.adcT<<4) & 0xF0
+	r[bme280RegData+6] = byte(s.adcH >> 8)
+	r[bme280RegData+7] = byte(s.adcH)
+	return conn
+}
+
+// bme280ReferenceHumidity is the 32 bit integer compensation of the datasheet, in %RH
+func bme280ReferenceHumidity(c bme280Calibration, adcT int32, adcH int32) float64 {
+	var1 := (((adcT >> 3) - int32(c.t1)<<1) * int32(c.t2)) >> 11
+	var2 := (((((adcT >> 4) - int32(c.t1)) * ((adcT >> 4) - int32(c.t1))) >> 12) * int32(c.t3)) >> 14
+	tFine := var1 + var2
+
+	v := tFine - 76800
+	v = ((((adcH << 14) - (int32(c.h4) << 20) - (int32(c.h5) * v)) + 16384) >> 15) *
+		(((((((v*int32(c.h6))>>10)*(((v*int32(c.h3))>>11)+32768))>>10)+2097152)*int32(c.h2) + 8192) >> 14)
+	v = v - (((((v >> 15) * (v >> 15)) >> 7) * int32(c.h1)) >> 4)
+	if v < 0 {
+		v = 0
+	}
+	if v > 419430400 {
+		v = 419430400
+	}
+	return float64(uint32(v)>>12) / 1024
+}
+
+func TestBME280Measure(t *testing.T) {
+	// temperature trimming and reading of the compensation example in the datasheet, 25.08 °C,
+	// humidity trimming of a production sensor
+	calib := bme280Calibration{
+		t1: 27504, t2: 26435, t3: -1000,
+		h1: 75, h2: 362, h3: 0, h4: 313, h5: 50, h6: 30,
+	}
+	tests := []struct {
+		name string
+		adcH int32
+	}{
+		{"dry", 24000},
+		{"normal", 28000},
+		{"humid", 34000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sample := bme280Sample{calib: calib, adcT: 519888, adcH: tt.adcH}
+			conn := newFakeBME280(sample)
+			d, err := newBME280(conn, "i2c-test", defaultBME280Address)
+			if err != nil {
+				t.Fatalf("newBME280: %s", err)
+			}
+			if d.calib != calib {
+				t.Fatalf("calibration = %+v, want %+v", d.calib, calib)
+			}
+
+			temp, humidity, err := d.measure()
+			if err != nil {
+				t.Fatalf("measure: %s", err)
+			}
+			if math.Abs(temp-25.08) > 0.01 {
+				t.Errorf("temperature = %.3f °C, want 25.08 °C", temp)
+			}
+			want := bme280ReferenceHumidity(calib, sample.adcT, sample.adcH)
+			if want <= 0 || want >= 100 {
+				t.Fatalf("reference humidity %.2f %%RH is clamped, pick another reading", want)
+			}
+			if math.Abs(humidity-want) > 0.1 {
+				t.Errorf("humidity = %.3f %%RH, want %.3f %%RH", humidity, want)
+			}
+
+			// ctrl_hum must be written before ctrl_meas starts the forced measurement
+			if conn.regs[bme280RegCtrlHum] != bme280HumX1 || conn.regs[bme280RegCtrlMeas] != bme280ForcedX1 {
+				t.Errorf("ctrl_hum = 0x%02x, ctrl_meas = 0x%02x", conn.regs[bme280RegCtrlHum], conn.regs[bme280RegCtrlMeas])
+			}
+			hum, meas := -1, -1
+			for i, w := range conn.writes {
+				if len(w) == 2 && w[0] == bme280RegCtrlHum {
+					hum = i
+				}
+				if len(w) == 2 && w[0] == bme280RegCtrlMeas {
+					meas = i
+				}
+			}
+			if hum < 0 || meas < hum {
+				t.Errorf("ctrl_hum written at %d, ctrl_meas at %d", hum, meas)
+			}
+		})
+	}
+}
+
+func TestBME280SkippedTemperature(t *testing.T) {
+	conn := newFakeBME280(bme280Sample{calib: bme280Calibration{t1: 27504, t2: 26435, t3: -1000}, adcT: 0x80000})
+	d, err := newBME280(conn, "i2c-test", defaultBME280Address)
+	if err != nil {
+		t.Fatalf("newBME280: %s", err)
+	}
+	_, err = d.Read()
+	if err == nil {
+		t.Error("Read accepted a skipped temperature measurement")
+	}
+}
+
+func TestBME280WrongChipID(t *testing.T) {
+	conn := newFakeBME280(bme280Sample{})
+	conn.regs[bme280RegChipID] = 0x58 // BMP280
+	_, err := newBME280(conn, "i2c-test", defaultBME280Address)
+	if err == nil {
+		t.Fatal("newBME280 accepted a BMP280")
+	}
+	if !conn.closed {
+		t.Error("connection was not closed")
+	}
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"rpi-heating-system/app/config"
+)
+
+// kJPerKWh is the number of kJ in one kWh
+const kJPerKWh = 3600
+
+// BufferTankState holds the calculated energy content of a buffer tank
+type BufferTankState struct {
+	EnergyKWh     float64 // energy stored above the empty temperature
+	ChargePercent float64 // stored energy relative to a tank at full temperature, 0-100
+}
+
+// bufferLayer is a horizontal tank layer measured by a single sensor
+type bufferLayer struct {
+	sensorID string
+	liters   float64
+}
+
+// BufferTankService calculates stored energy and charge level of a stratified buffer tank
+// It only depends on TempSensorReader, so any reader implementation can be used as the data source
+type BufferTankService struct {
+	tempReader  TempSensorReader
+	layers      []*bufferLayer
+	emptyTemp   float64
+	capacityKWh float64 // energy stored in a tank at full temperature
+}
+
+// NewBufferTankService creates a new BufferTankService for the configured buffer tank
+func NewBufferTankService(tempReader TempSensorReader, conf *config.AppConfig) (*BufferTankService, error) {
+	cfg := conf.BufferTank
+	if cfg == nil {
+		return nil, fmt.Errorf("buffer tank is not configured")
+	}
+	if cfg.VolumeLiters <= 0 {
+		return nil, fmt.Errorf("buffer tank %s volume must be positive", cfg.Name)
+	}
+	if cfg.FullTemp <= cfg.EmptyTemp {
+		return nil, fmt.Errorf("buffer tank %s full temperature must be above the empty temperature", cfg.Name)
+	}
+	if len(cfg.Layers) == 0 {
+		return nil, fmt.Errorf("buffer tank %s has no layers", cfg.Name)
+	}
+
+	sensors := make(map[string]bool)
+	for _, sensor := range conf.TempSensors {
+		sensors[sensor.ID] = true
+	}
+
+	// layers without an explicit share split the remaining volume equally
+	assigned := 0.0
+	unassigned := 0
+	for _, layer := range cfg.Layers {
+		if !sensors[layer.SensorID] {
+			return nil, fmt.Errorf("buffer tank %s layer sensor %s does not exist", cfg.Name, layer.SensorID)
+		}
+		if layer.VolumeShare < 0 {
+			return nil, fmt.Errorf("buffer tank %s layer %s volume share must not be negative", cfg.Name, layer.SensorID)
+		}
+		assigned += layer.VolumeShare
+		if layer.VolumeShare == 0 {
+			unassigned++
+		}
+	}
+	if assigned > 1 || (unassigned == 0 && math.Abs(assigned-1) > 0.001) {
+		return nil, fmt.Errorf("buffer tank %s layer volume shares must add up to 1", cfg.Name)
+	}
+
+	bt := &BufferTankService{
+		tempReader:  tempReader,
+		emptyTemp:   cfg.EmptyTemp,
+		capacityKWh: cfg.VolumeLiters * waterHeatCapacity / kJPerKWh * (cfg.FullTemp - cfg.EmptyTemp),
+	}
+	for _, layer := range cfg.Layers {
+		share := layer.VolumeShare
+		if share == 0 {
+			share = (1 - assigned) / float64(unassigned)
+		}
+		bt.layers = append(bt.layers, &bufferLayer{
+			sensorID: layer.SensorID,
+			liters:   cfg.VolumeLiters * share,
+		})
+	}
+	return bt, nil
+}
+
+// Calculate reads all layer sensors and returns the stored energy and charge level
+// Layers colder than the empty temperature contribute no energy
+func (obj *BufferTankService) Calculate() (BufferTankState, error) {
+	energy := 0.0
+	for _, layer := range obj.layers {
+		temp, err := obj.tempReader.Read(layer.sensorID)
+		if err != nil {
+			return BufferTankState{}, fmt.Errorf("failed to read buffer layer sensor %s: %w", layer.sensorID, err)
+		}
+		energy += layer.liters * waterHeatCapacity / kJPerKWh * math.Max(0, temp-obj.emptyTemp)
+	}
+
+	charge := math.Max(0, math.Min(100, energy/obj.capacityKWh*100))
+	return BufferTankState{
+		EnergyKWh:     energy,
+		ChargePercent: charge,
+	}, nil
+}
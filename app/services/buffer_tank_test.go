@@ -0,0 +1,161 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"rpi-heating-system/app/config"
+	"testing"
+)
+
+// fakeTempReader returns fixed temperatures, unknown sensors fail to read
+type fakeTempReader map[string]float64
+
+func (obj fakeTempReader) Read(id string) (float64, error) {
+	temp, ok := obj[id]
+	if !ok {
+		return 0.0, fmt.Errorf("sensor %s not found", id)
+	}
+	return temp, nil
+}
+
+// bufferTankConfig returns a 1000 l tank between 30 and 80 °C with the layers
+func bufferTankConfig(layers ...*config.BufferLayerConfig) *config.AppConfig {
+	conf := &config.AppConfig{
+		BufferTank: &config.BufferTankConfig{
+			Name:         "Buffer",
+			VolumeLiters: 1000,
+			EmptyTemp:    30,
+			FullTemp:     80,
+			Layers:       layers,
+		},
+	}
+	for _, id := range []string{"top", "middle", "bottom"} {
+		conf.TempSensors = append(conf.TempSensors, &config.TempSensorsConfig{ID: id})
+	}
+	return conf
+}
+
+func TestBufferTankCalculate(t *testing.T) {
+	// energy of the full tank, 1000 l heated by 50 K
+	full := 1000 * waterHeatCapacity / kJPerKWh * 50
+
+	equal := []*config.BufferLayerConfig{{SensorID: "top"}, {SensorID: "middle"}, {SensorID: "bottom"}}
+	shared := []*config.BufferLayerConfig{{SensorID: "top", VolumeShare: 0.5}, {SensorID: "middle"}, {SensorID: "bottom"}}
+
+	tests := []struct {
+		name   string
+		layers []*config.BufferLayerConfig
+		temps  fakeTempReader
+		energy float64
+		charge float64
+	}{
+		{
+			name:   "full tank",
+			layers: equal,
+			temps:  fakeTempReader{"top": 80, "middle": 80, "bottom": 80},
+			energy: full,
+			charge: 100,
+		},
+		{
+			name:   "empty tank",
+			layers: equal,
+			temps:  fakeTempReader{"top": 30, "middle": 30, "bottom": 30},
+			energy: 0,
+			charge: 0,
+		},
+		{
+			name:   "default shares split the volume equally",
+			layers: equal,
+			temps:  fakeTempReader{"top": 80, "middle": 55, "bottom": 30},
+			energy: full / 2,
+			charge: 50,
+		},
+		{
+			name:   "layers colder than empty contribute nothing",
+			layers: equal,
+			temps:  fakeTempReader{"top": 80, "middle": 20, "bottom": 10},
+			energy: full / 3,
+			charge: 100.0 / 3,
+		},
+		{
+			name:   "all layers colder than empty",
+			layers: equal,
+			temps:  fakeTempReader{"top": 25, "middle": 20, "bottom": 10},
+			energy: 0,
+			charge: 0,
+		},
+		{
+			name:   "charge above full temperature is clamped",
+			layers: equal,
+			temps:  fakeTempReader{"top": 90, "middle": 90, "bottom": 90},
+			energy: full * 60 / 50,
+			charge: 100,
+		},
+		{
+			name:   "explicit share with default rest",
+			layers: shared,
+			temps:  fakeTempReader{"top": 80, "middle": 30, "bottom": 30},
+			energy: full / 2,
+			charge: 50,
+		},
+		{
+			name:   "default rest with explicit share",
+			layers: shared,
+			temps:  fakeTempReader{"top": 30, "middle": 80, "bottom": 30},
+			energy: full / 4,
+			charge: 25,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bt, err := NewBufferTankService(tt.temps, bufferTankConfig(tt.layers...))
+			if err != nil {
+				t.Fatalf("NewBufferTankService: %s", err)
+			}
+			state, err := bt.Calculate()
+			if err != nil {
+				t.Fatalf("Calculate: %s", err)
+			}
+			if math.Abs(state.EnergyKWh-tt.energy) > 1e-9 {
+				t.Errorf("energy = %.6f kWh, want %.6f kWh", state.EnergyKWh, tt.energy)
+			}
+			if math.Abs(state.ChargePercent-tt.charge) > 1e-9 {
+				t.Errorf("charge = %.6f %%, want %.6f %%", state.ChargePercent, tt.charge)
+			}
+		})
+	}
+}
+
+func TestBufferTankReadError(t *testing.T) {
+	layers := []*config.BufferLayerConfig{{SensorID: "top"}, {SensorID: "middle"}}
+	bt, err := NewBufferTankService(fakeTempReader{"top": 60}, bufferTankConfig(layers...))
+	if err != nil {
+		t.Fatalf("NewBufferTankService: %s", err)
+	}
+	_, err = bt.Calculate()
+	if err == nil {
+		t.Error("Calculate succeeded with an unreadable layer sensor")
+	}
+}
+
+func TestNewBufferTankServiceInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers []*config.BufferLayerConfig
+	}{
+		{"no layers", nil},
+		{"unknown sensor", []*config.BufferLayerConfig{{SensorID: "top"}, {SensorID: "tpo"}}},
+		{"negative share", []*config.BufferLayerConfig{{SensorID: "top", VolumeShare: -0.5}}},
+		{"shares above 1", []*config.BufferLayerConfig{{SensorID: "top", VolumeShare: 0.7}, {SensorID: "bottom", VolumeShare: 0.7}}},
+		{"shares below 1", []*config.BufferLayerConfig{{SensorID: "top", VolumeShare: 0.3}, {SensorID: "bottom", VolumeShare: 0.3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewBufferTankService(fakeTempReader{}, bufferTankConfig(tt.layers...))
+			if err == nil {
+				t.Error("NewBufferTankService accepted an invalid config")
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"fmt"
+	"rpi-heating-system/app/config"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// bindingKey identifies the gesture of a button
+type bindingKey struct {
+	buttonID int
+	gesture  ButtonGesture
+}
+
+// ButtonBindingService switches pumps on button gestures, without Home Assistant or the network
+// Every switching action starts a manual override, state changes are reported by the pump state observers
+type ButtonBindingService struct {
+	overrideSvc *OverrideService
+	gestureSvc  *GestureService
+	observerID  GestureObserverID
+	bindings    map[bindingKey][]*config.ButtonBindingConfig
+}
+
+// NewButtonBindingService creates a new ButtonBindingService and registers it for the gestures of all bound buttons
+func NewButtonBindingService(
+	overrideSvc *OverrideService,
+	gestureSvc *GestureService,
+	conf *config.AppConfig,
+) (*ButtonBindingService, error) {
+
+	bs := &ButtonBindingService{
+		overrideSvc: overrideSvc,
+		gestureSvc:  gestureSvc,
+		bindings:    make(map[bindingKey][]*config.ButtonBindingConfig),
+	}
+
+	buttons := make(map[int]bool)
+	for _, button := range conf.Buttons {
+		buttons[button.ID] = true
+	}
+	pumps := make(map[int]bool)
+	for _, pump := range conf.Pumps {
+		pumps[pump.ID] = true
+	}
+	gestures := make(map[ButtonGesture]bool)
+	for _, gesture := range ButtonGestures {
+		gestures[gesture] = true
+	}
+
+	for _, binding := range conf.Bindings {
+		gesture := ButtonGesture(binding.Gesture)
+		switch {
+		case !buttons[binding.ButtonID]:
+			return nil, fmt.Errorf("button binding button %d does not exist", binding.ButtonID)
+		case !pumps[binding.PumpID]:
+			return nil, fmt.Errorf("button %d binding pump %d does not exist", binding.ButtonID, binding.PumpID)
+		case !gestures[gesture]:
+			return nil, fmt.Errorf("button %d binding has unknown gesture %q", binding.ButtonID, binding.Gesture)
+		}
+		switch binding.Action {
+		case config.BindingToggle:
+			// hold repeats while the button is pressed, a toggle would flap the pump
+			if gesture == GestureHold {
+				return nil, fmt.Errorf("button %d toggle binding cannot use the hold gesture", binding.ButtonID)
+			}
+		case config.BindingForceOn, config.BindingForceOff, config.BindingCancelOverride:
+		default:
+			return nil, fmt.Errorf("button %d binding has unknown action %q", binding.ButtonID, binding.Action)
+		}
+		if binding.Minutes < 0 {
+			return nil, fmt.Errorf("button %d binding minutes must not be negative", binding.ButtonID)
+		}
+		key := bindingKey{buttonID: binding.ButtonID, gesture: gesture}
+		bs.bindings[key] = append(bs.bindings[key], binding)
+	}
+
+	bs.observerID = gestureSvc.AddObserver(bs.onGesture)
+	return bs, nil
+}
+
+// Close stops reacting to the button gestures, running overrides are left to the OverrideService
+func (obj *ButtonBindingService) Close() error {
+	return obj.gestureSvc.RemoveObserver(obj.observerID)
+}
+
+// onGesture runs the actions bound to the gesture of the button
+func (obj *ButtonBindingService) onGesture(button *config.ButtonConfig, gesture ButtonGesture) {
+	for _, binding := range obj.bindings[bindingKey{buttonID: button.ID, gesture: gesture}] {
+		err := obj.runAction(binding)
+		if err != nil {
+			log.Error().Msgf("button %s %s action %s on pump %d failed: %s", button.Name, gesture, binding.Action, binding.PumpID, err)
+		}
+	}
+}
+
+// runAction overrides the pump as the binding requests
+func (obj *ButtonBindingService) runAction(binding *config.ButtonBindingConfig) error {
+	pumpID := PumpID(binding.PumpID)
+	if binding.Action == config.BindingCancelOverride {
+		log.Info().Msgf("Button binding cancels pump %d override", pumpID)
+		return obj.overrideSvc.Cancel(pumpID)
+	}
+
+	state := PumpOFF
+	switch binding.Action {
+	case config.BindingToggle:
+		// the pump may still run with its old state while a delayed override is pending,
+		// toggling the requested override state keeps repeated presses consistent
+		current, err := obj.toggleBase(pumpID)
+		if err != nil {
+			return err
+		}
+		if current == PumpOFF {
+			state = PumpON
+		}
+	case config.BindingForceOn:
+		state = PumpON
+	}
+
+	duration := obj.overrideSvc.DefaultDuration(pumpID)
+	if binding.Minutes > 0 {
+		duration = time.Duration(binding.Minutes) * time.Minute
+	}
+	log.Info().Msgf("Button binding overrides pump %d %s for %s", pumpID, stateName(state), duration)
+	return obj.overrideSvc.Override(pumpID, state, duration)
+}
+
+// toggleBase returns the state a toggle flips, the active override if there is one, otherwise the pump state
+func (obj *ButtonBindingService) toggleBase(pumpID PumpID) (PumpState, error) {
+	override, ok := obj.overrideSvc.ActiveOverride(pumpID)
+	if ok {
+		return override.State, nil
+	}
+	return obj.overrideSvc.GetPumpState(pumpID)
+}
+
+// stateName returns the human readable name of the pump state
+func stateName(state PumpState) string {
+	if state == PumpON {
+		return "ON"
+	}
+	return "OFF"
+}
@@ -0,0 +1,305 @@
+package services
+
+import (
+	"fmt"
+	"rpi-heating-system/app/config"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/warthog618/gpiod"
+)
+
+// ButtonGesture represents a gesture recognized from the edges of a button
+type ButtonGesture string
+
+const (
+	GestureShortPress  ButtonGesture = "short_press"  // released before long_press_ms, no second click followed
+	GestureLongPress   ButtonGesture = "long_press"   // released after at least long_press_ms
+	GestureDoublePress ButtonGesture = "double_press" // second short click started within double_click_ms
+	GestureHold        ButtonGesture = "hold"         // still pressed after long_press_ms, repeated each hold_repeat_ms
+)
+
+// ButtonGestures lists all gestures in the order they are announced
+var ButtonGestures = []ButtonGesture{GestureShortPress, GestureLongPress, GestureDoublePress, GestureHold}
+
+const (
+	defaultLongPress   = 800 * time.Millisecond
+	defaultDoubleClick = 400 * time.Millisecond
+	defaultHoldRepeat  = 500 * time.Millisecond
+)
+
+// GestureObserver is called with the button and every gesture recognized on it
+type GestureObserver func(button *config.ButtonConfig, gesture ButtonGesture)
+
+// GestureObserverID identifies a registered GestureObserver
+type GestureObserverID int
+
+// gestureObserverEntry is a registered observer with its ID
+type gestureObserverEntry struct {
+	id       GestureObserverID
+	observer GestureObserver
+}
+
+// gestureRecognizer tracks the edges of a single button
+// Durations are measured from the kernel event timestamps, timers only trigger the gestures
+// that are recognized without an edge: hold and the end of the double click window
+type gestureRecognizer struct {
+	cfg         *config.ButtonConfig
+	longPress   time.Duration
+	doubleClick time.Duration
+	holdRepeat  time.Duration
+
+	pressed    bool
+	pressedAt  time.Duration // event timestamp of the last press
+	releasedAt time.Duration // event timestamp of the last release
+	clicks     int           // short clicks waiting for the double click window to pass
+	holding    bool          // hold was emitted during the current press
+	gen        int           // incremented on every edge, timers of older generations are ignored
+	holdTimer  *time.Timer
+	clickTimer *time.Timer
+}
+
+// GestureService recognizes short press, long press, double click and hold gestures from the button events
+type GestureService struct {
+	buttonSvc     ButtonService
+	mu            sync.Mutex
+	recognizers   map[int]*gestureRecognizer // keyed by GPIO pin
+	subscriptions []*BtnPressSubscription
+	observers     []gestureObserverEntry
+	nextObserver  GestureObserverID
+	closed        bool
+}
+
+// NewGestureService creates a new GestureService and subscribes to the events of all buttons
+func NewGestureService(buttonSvc ButtonService, buttons []*config.ButtonConfig) (*GestureService, error) {
+	gs := &GestureService{
+		buttonSvc:   buttonSvc,
+		recognizers: make(map[int]*gestureRecognizer),
+	}
+
+	ids := make(map[int]bool)
+	for _, button := range buttons {
+		if ids[button.ID] {
+			return nil, fmt.Errorf("button id %d is not unique", button.ID)
+		}
+		ids[button.ID] = true
+		r := &gestureRecognizer{
+			cfg:         button,
+			longPress:   defaultLongPress,
+			doubleClick: defaultDoubleClick,
+			holdRepeat:  defaultHoldRepeat,
+		}
+		if button.LongPressMs > 0 {
+			r.longPress = time.Duration(button.LongPressMs) * time.Millisecond
+		}
+		if button.DoubleClickMs != nil {
+			r.doubleClick = time.Duration(*button.DoubleClickMs) * time.Millisecond
+		}
+		if button.HoldRepeatMs > 0 {
+			r.holdRepeat = time.Duration(button.HoldRepeatMs) * time.Millisecond
+		}
+		gs.recognizers[button.GpioInputPin] = r
+	}
+
+	for _, button := range buttons {
+		sub, err := buttonSvc.SubscribeOnButtonPress(button.GpioInputPin, "gestures")
+		if err != nil {
+			gs.Close()
+			return nil, fmt.Errorf("failed to subscribe to button %s, err: %w", button.Name, err)
+		}
+		gs.subscriptions = append(gs.subscriptions, sub)
+		go func() {
+			for evt := range sub.EventCh {
+				gs.onEvent(evt)
+			}
+		}()
+	}
+	return gs, nil
+}
+
+// AddObserver registers a callback called for every recognized gesture and returns its ID for RemoveObserver
+func (obj *GestureService) AddObserver(observer GestureObserver) GestureObserverID {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.nextObserver++
+	obj.observers = append(obj.observers, gestureObserverEntry{id: obj.nextObserver, observer: observer})
+	return obj.nextObserver
+}
+
+// RemoveObserver unregisters the observer with the specified ID
+func (obj *GestureService) RemoveObserver(id GestureObserverID) error {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	for i, entry := range obj.observers {
+		if entry.id == id {
+			// copy so a notify in progress keeps iterating its own snapshot
+			observers := make([]gestureObserverEntry, 0, len(obj.observers)-1)
+			observers = append(observers, obj.observers[:i]...)
+			obj.observers = append(observers, obj.observers[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("gesture observer %d is not registered", id)
+}
+
+// Close stops the recognition and unsubscribes from the button events
+func (obj *GestureService) Close() error {
+	obj.mu.Lock()
+	obj.closed = true
+	for _, r := range obj.recognizers {
+		r.gen++
+		r.stopTimers()
+	}
+	subs := obj.subscriptions
+	obj.subscriptions = nil
+	obj.mu.Unlock()
+
+	for _, sub := range subs {
+		err := obj.buttonSvc.Unsubscribe(sub.SID)
+		if err != nil {
+			return fmt.Errorf("failed to unsubscribe from button %s, err: %w", sub.SID, err)
+		}
+	}
+	return nil
+}
+
+// onEvent feeds a button event to the recognizer of its button
+func (obj *GestureService) onEvent(evt gpiod.LineEvent) {
+	obj.mu.Lock()
+	r, ok := obj.recognizers[evt.Offset]
+	if !ok || obj.closed {
+		obj.mu.Unlock()
+		return
+	}
+	var gestures []ButtonGesture
+	if IsPressed(evt) {
+		gestures = obj.onPress(r, evt.Timestamp)
+	} else {
+		gestures = obj.onRelease(r, evt.Timestamp)
+	}
+	obj.mu.Unlock()
+
+	obj.notify(r.cfg, gestures)
+}
+
+// onPress handles the start of a press, must be called with the lock held
+func (obj *GestureService) onPress(r *gestureRecognizer, ts time.Duration) []ButtonGesture {
+	if r.pressed {
+		return nil
+	}
+	var gestures []ButtonGesture
+	// the window timer may not have fired yet, the timestamps decide
+	if r.clicks > 0 && ts-r.releasedAt > r.doubleClick {
+		gestures = append(gestures, GestureShortPress)
+		r.clicks = 0
+	}
+	r.gen++
+	r.stopTimers()
+	r.pressed = true
+	r.pressedAt = ts
+	r.holding = false
+	r.holdTimer = obj.afterFunc(r, r.longPress, obj.onHold)
+	return gestures
+}
+
+// onRelease handles the end of a press, must be called with the lock held
+func (obj *GestureService) onRelease(r *gestureRecognizer, ts time.Duration) []ButtonGesture {
+	if !r.pressed {
+		return nil
+	}
+	r.gen++
+	r.stopTimers()
+	r.pressed = false
+	r.releasedAt = ts
+
+	var gestures []ButtonGesture
+	if r.holding || ts-r.pressedAt >= r.longPress {
+		if r.clicks > 0 {
+			gestures = append(gestures, GestureShortPress)
+			r.clicks = 0
+		}
+		r.holding = false
+		return append(gestures, GestureLongPress)
+	}
+
+	switch {
+	case r.clicks > 0:
+		r.clicks = 0
+		gestures = append(gestures, GestureDoublePress)
+	case r.doubleClick <= 0:
+		gestures = append(gestures, GestureShortPress)
+	default:
+		r.clicks = 1
+		r.clickTimer = obj.afterFunc(r, r.doubleClick, obj.onClickTimeout)
+	}
+	return gestures
+}
+
+// onHold emits hold while the button stays pressed, must be called with the lock held
+func (obj *GestureService) onHold(r *gestureRecognizer) []ButtonGesture {
+	if !r.pressed {
+		return nil
+	}
+	var gestures []ButtonGesture
+	// a short click followed by a hold is not a double click
+	if r.clicks > 0 {
+		gestures = append(gestures, GestureShortPress)
+		r.clicks = 0
+	}
+	r.holding = true
+	r.holdTimer = obj.afterFunc(r, r.holdRepeat, obj.onHold)
+	return append(gestures, GestureHold)
+}
+
+// onClickTimeout emits the short press once no second click followed, must be called with the lock held
+func (obj *GestureService) onClickTimeout(r *gestureRecognizer) []ButtonGesture {
+	if r.pressed || r.clicks == 0 {
+		return nil
+	}
+	r.clicks = 0
+	return []ButtonGesture{GestureShortPress}
+}
+
+// afterFunc runs fn with the lock held after d, unless an edge arrived or the service was closed in the meantime
+func (obj *GestureService) afterFunc(r *gestureRecognizer, d time.Duration, fn func(r *gestureRecognizer) []ButtonGesture) *time.Timer {
+	gen := r.gen
+	return time.AfterFunc(d, func() {
+		obj.mu.Lock()
+		if obj.closed || r.gen != gen {
+			obj.mu.Unlock()
+			return
+		}
+		gestures := fn(r)
+		obj.mu.Unlock()
+		obj.notify(r.cfg, gestures)
+	})
+}
+
+// notify calls all observers with the gestures, without holding the lock
+func (obj *GestureService) notify(button *config.ButtonConfig, gestures []ButtonGesture) {
+	if len(gestures) == 0 {
+		return
+	}
+	obj.mu.Lock()
+	observers := obj.observers
+	obj.mu.Unlock()
+	for _, gesture := range gestures {
+		log.Info().Msgf("Button %s gesture %s", button.Name, gesture)
+		for _, entry := range observers {
+			entry.observer(button, gesture)
+		}
+	}
+}
+
+// stopTimers stops the pending timers of the recognizer
+func (obj *gestureRecognizer) stopTimers() {
+	if obj.holdTimer != nil {
+		obj.holdTimer.Stop()
+		obj.holdTimer = nil
+	}
+	if obj.clickTimer != nil {
+		obj.clickTimer.Stop()
+		obj.clickTimer = nil
+	}
+}
@@ -2,7 +2,10 @@ package services
 
 import (
 	"fmt"
+	"io"
 	"rpi-heating-system/app/config"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -19,15 +22,29 @@ type BtnPressSubscription struct {
 	EventCh chan gpiod.LineEvent
 }
 
+// defaultButtonDebounce is used for buttons without debounce_ms
+const defaultButtonDebounce = 20 * time.Millisecond
+
+// buttonEventBuffer is the number of events a subscriber may fall behind before events are dropped
+const buttonEventBuffer = 16
+
 // ButtonService is an interface that defines the operations for button press events
 type ButtonService interface {
 	SubscribeOnButtonPress(gpio int, observerIdentifier string) (*BtnPressSubscription, error)
 	Unsubscribe(subscriptionID SubscriptionID) error
+	DroppedEvents() uint64
+	io.Closer
 }
 
 // ButtonHandler represents a handler for button press events using GPIO lines
+// Events are delivered to buffered subscription channels without blocking,
+// a subscriber that does not keep up loses events instead of stalling the edge detection of all buttons
 type ButtonHandler struct {
+	mu        sync.RWMutex
 	observers map[SubscriptionID]*BtnPressSubscription
+	lines     []*gpiod.Line
+	closed    bool
+	dropped   atomic.Uint64
 }
 
 // NewButtonHandler creates a new ButtonHandler with the given GPIO configuration and button configurations
@@ -37,35 +54,84 @@ func NewButtonHandler(gpiodChip *gpiod.Chip, btnsCfg []*config.ButtonConfig) (*B
 		observers: make(map[SubscriptionID]*BtnPressSubscription),
 	}
 	for _, btn := range btnsCfg {
-		l, err := gpiodChip.RequestLine(
-			btn.GpioInputPin,
-			gpiod.WithBothEdges,
-			gpiod.WithEventHandler(bh.eventHandler),
-			gpiod.WithDebounce(20*time.Millisecond),
-		)
+		opts, err := buttonLineOptions(btn)
 		if err != nil {
-			return nil, fmt.Errorf("failed to request %s GPIO line %d: %w", btn.Name, btn.GpioInputPin, err)
+			bh.Close()
+			return nil, err
 		}
-		if btn.EnablePullUp {
-			l.Reconfigure(gpiod.WithPullUp)
+		opts = append(opts, gpiod.WithBothEdges, gpiod.WithEventHandler(bh.eventHandler))
+		// polarity, bias and debounce are applied with the request, the line is never active misconfigured
+		l, err := gpiodChip.RequestLine(btn.GpioInputPin, opts...)
+		if err != nil {
+			bh.Close()
+			return nil, fmt.Errorf("failed to request %s GPIO line %d: %w", btn.Name, btn.GpioInputPin, err)
 		}
+		bh.lines = append(bh.lines, l)
 	}
 
 	return bh, nil
 }
 
+// buttonLineOptions returns the polarity, bias and debounce line options of the button
+func buttonLineOptions(btn *config.ButtonConfig) ([]gpiod.LineReqOption, error) {
+	var opts []gpiod.LineReqOption
+	if btn.ActiveLow == nil || *btn.ActiveLow {
+		opts = append(opts, gpiod.AsActiveLow)
+	}
+
+	bias := btn.Bias
+	if bias == "" && btn.EnablePullUp {
+		bias = config.BiasPullUp
+	}
+	switch bias {
+	case "":
+	case config.BiasPullUp:
+		opts = append(opts, gpiod.WithPullUp)
+	case config.BiasPullDown:
+		opts = append(opts, gpiod.WithPullDown)
+	case config.BiasDisabled:
+		opts = append(opts, gpiod.WithBiasDisabled)
+	default:
+		return nil, fmt.Errorf("button %s has unknown bias %q", btn.Name, btn.Bias)
+	}
+
+	debounce := defaultButtonDebounce
+	if btn.DebounceMs != nil {
+		if *btn.DebounceMs < 0 {
+			return nil, fmt.Errorf("button %s debounce must not be negative", btn.Name)
+		}
+		debounce = time.Duration(*btn.DebounceMs) * time.Millisecond
+	}
+	if debounce > 0 {
+		opts = append(opts, gpiod.WithDebounce(debounce))
+	}
+	return opts, nil
+}
+
+// IsPressed returns true if the event is the start of a button press
+// Lines are requested with the configured polarity, so the kernel reports a press as a rising edge of the active level
+func IsPressed(evt gpiod.LineEvent) bool {
+	return evt.Type == gpiod.LineEventRisingEdge
+}
+
 // SubscribeOnButtonPress subscribes to button press events for the specified GPIO pin
 func (obj *ButtonHandler) SubscribeOnButtonPress(gpio int, observerIdentifier string) (*BtnPressSubscription, error) {
 	log.Info().Msgf("SubscribeOnButtonPress: %v", gpio)
 
 	sid := SubscriptionID(fmt.Sprintf("btn-%s-%d", observerIdentifier, gpio))
 
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+
+	if obj.closed {
+		return nil, fmt.Errorf("button handler is closed")
+	}
 	// check if sid already exists in the map
 	if _, ok := obj.observers[sid]; ok {
 		return nil, fmt.Errorf("observer with id %s already exists", sid)
 	}
 
-	ch := make(chan gpiod.LineEvent)
+	ch := make(chan gpiod.LineEvent, buttonEventBuffer)
 	sub := &BtnPressSubscription{
 		SID:     sid,
 		GpioPin: gpio,
@@ -76,27 +142,72 @@ func (obj *ButtonHandler) SubscribeOnButtonPress(gpio int, observerIdentifier st
 	return sub, nil
 }
 
-// Unsubscribe removes the subscription with the specified ID
+// Unsubscribe removes the subscription with the specified ID and closes its channel
 func (obj *ButtonHandler) Unsubscribe(subscriptionID SubscriptionID) error {
 	log.Info().Msgf("Unsubscribe: %v", subscriptionID)
 
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+
 	// check if sid already exists in the map
-	if _, ok := obj.observers[subscriptionID]; !ok {
+	sub, ok := obj.observers[subscriptionID]
+	if !ok {
 		return fmt.Errorf("observer with id %s does not exist", subscriptionID)
 	}
-	// close channel and remove from map
-	close(obj.observers[subscriptionID].EventCh)
+	// the event handler sends only while holding the read lock, so the channel is never closed during a send
+	close(sub.EventCh)
 	delete(obj.observers, subscriptionID)
 	return nil
 }
 
+// DroppedEvents returns the number of events dropped because a subscriber channel was full
+func (obj *ButtonHandler) DroppedEvents() uint64 {
+	return obj.dropped.Load()
+}
+
+// Close closes all subscriptions and releases the GPIO lines
+func (obj *ButtonHandler) Close() error {
+	obj.mu.Lock()
+	if obj.closed {
+		obj.mu.Unlock()
+		return nil
+	}
+	obj.closed = true
+	for sid, sub := range obj.observers {
+		close(sub.EventCh)
+		delete(obj.observers, sid)
+	}
+	lines := obj.lines
+	obj.lines = nil
+	obj.mu.Unlock()
+
+	// the event handler takes the lock as well, the lines are released without holding it
+	var firstErr error
+	for _, l := range lines {
+		err := l.Close()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to release GPIO line %d: %w", l.Offset(), err)
+		}
+	}
+	return firstErr
+}
+
 // eventHandler handles button press events
+// It is called from the gpiod watcher goroutine and must never block
 func (obj *ButtonHandler) eventHandler(evt gpiod.LineEvent) {
 	log.Info().Msgf("button eventHandler: %v", evt)
+	obj.mu.RLock()
+	defer obj.mu.RUnlock()
 	for _, sub := range obj.observers {
-		if sub.GpioPin == evt.Offset {
-			log.Info().Msgf("publishing event: %v to sub: %v", evt, sub)
-			sub.EventCh <- evt
+		if sub.GpioPin != evt.Offset {
+			continue
+		}
+		select {
+		case sub.EventCh <- evt:
+			log.Info().Msgf("publishing event: %v to sub: %v", evt, sub.SID)
+		default:
+			dropped := obj.dropped.Add(1)
+			log.Warn().Msgf("Subscriber %s is not keeping up, event %v dropped (%d in total)", sub.SID, evt, dropped)
 		}
 	}
 }
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"rpi-heating-system/app/config"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// calibrationSamples is the number of reads averaged per sensor during calibration
+	calibrationSamples = 5
+	// calibrationDelay is the pause between two calibration reads
+	calibrationDelay = time.Second
+)
+
+// linearCorrection converts a raw reading to a calibrated one
+type linearCorrection struct {
+	scale  float64
+	offset float64
+}
+
+// CalibratedReader applies the per-sensor scale and offset from the config to the readings of another reader
+type CalibratedReader struct {
+	reader      TempSensorReader
+	corrections map[string]linearCorrection
+}
+
+// NewCalibratedReader creates a new CalibratedReader for all configured temperature sensors
+func NewCalibratedReader(reader TempSensorReader, sensors []*config.TempSensorsConfig) *CalibratedReader {
+	cr := &CalibratedReader{
+		reader:      reader,
+		corrections: make(map[string]linearCorrection),
+	}
+	for _, sensor := range sensors {
+		if sensor.Offset == 0 && (sensor.Scale == 0 || sensor.Scale == 1) {
+			continue
+		}
+		cr.corrections[sensor.ID] = linearCorrection{scale: sensorScale(sensor), offset: sensor.Offset}
+	}
+	return cr
+}
+
+// Read returns the calibrated temperature of the sensor in °C
+func (obj *CalibratedReader) Read(id string) (float64, error) {
+	temp, err := obj.reader.Read(id)
+	if err != nil {
+		return 0.0, err
+	}
+	c, ok := obj.corrections[id]
+	if !ok {
+		return temp, nil
+	}
+	return temp*c.scale + c.offset, nil
+}
+
+// CalibrateSensors reads the selected sensors placed in a bath of the reference temperature
+// and sets their offsets, so the calibrated readings match the reference
+// Without ids all DS18B20 probes are selected, other sensor types usually cannot be put into the bath.
+// Sensors that cannot be read keep their offset, an error is returned only if no sensor was calibrated
+func CalibrateSensors(reader TempSensorReader, sensors []*config.TempSensorsConfig, ids []string, reference float64) error {
+	selected := make(map[string]bool)
+	for _, id := range ids {
+		selected[id] = true
+	}
+	known := make(map[string]bool)
+	for _, sensor := range sensors {
+		known[sensor.ID] = true
+	}
+	for _, id := range ids {
+		if !known[id] {
+			return fmt.Errorf("calibration sensor %s does not exist", id)
+		}
+	}
+
+	calibrated := 0
+	for _, sensor := range sensors {
+		skip := sensor.DriverType() != config.SensorTypeDS18B20
+		if len(ids) > 0 {
+			skip = !selected[sensor.ID]
+		}
+		if skip {
+			log.Info().Msgf("Sensor %s (%s) of type %s skipped, not selected for calibration", sensor.ID, sensor.Name, sensor.DriverType())
+			continue
+		}
+		raw, err := averageReading(reader, sensor.ID)
+		if err != nil {
+			log.Error().Msgf("failed to calibrate sensor %s: %s", sensor.ID, err)
+			continue
+		}
+		offset := reference - raw*sensorScale(sensor)
+		log.Info().Msgf("Sensor %s (%s) raw %.3f °C, offset %.3f -> %.3f", sensor.ID, sensor.Name, raw, sensor.Offset, offset)
+		sensor.Offset = offset
+		calibrated++
+	}
+	if calibrated == 0 {
+		return errors.New("no sensor calibrated")
+	}
+	return nil
+}
+
+// averageReading returns the average of several raw reads of the sensor
+func averageReading(reader TempSensorReader, id string) (float64, error) {
+	sum := 0.0
+	for i := 0; i < calibrationSamples; i++ {
+		if i > 0 {
+			time.Sleep(calibrationDelay)
+		}
+		temp, err := reader.Read(id)
+		if err != nil {
+			return 0.0, fmt.Errorf("read %d failed: %w", i+1, err)
+		}
+		sum += temp
+	}
+	return sum / calibrationSamples, nil
+}
+
+// sensorScale returns the configured scale of the sensor, 1 if not set
+func sensorScale(sensor *config.TempSensorsConfig) float64 {
+	if sensor.Scale == 0 {
+		return 1
+	}
+	return sensor.Scale
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// i2cSlave is the i2c-dev ioctl selecting the address of the following transfers
+	i2cSlave = 0x0703
+	// spiIocWrMode is the spidev ioctl setting the SPI mode
+	spiIocWrMode = 0x40016b01
+	// spiIocMessage1 is the spidev ioctl running a single full-duplex transfer
+	spiIocMessage1 = 0x40206b00
+)
+
+var (
+	deviceLocksMu sync.Mutex
+	deviceLocks   = make(map[string]*sync.Mutex)
+)
+
+// deviceLock returns the lock serializing multi-step transactions with a single chip
+// Sensors sharing a chip, like the channels of an ADC, must not interleave their transactions
+func deviceLock(key string) *sync.Mutex {
+	deviceLocksMu.Lock()
+	defer deviceLocksMu.Unlock()
+	lock, ok := deviceLocks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		deviceLocks[key] = lock
+	}
+	return lock
+}
+
+// i2cConn exchanges data with a single chip on an I2C bus
+type i2cConn interface {
+	Write(data []byte) error
+	Read(data []byte) error
+	Close() error
+}
+
+// spiConn exchanges data with a single chip on a SPI bus
+type spiConn interface {
+	Transfer(tx []byte, rx []byte) error
+	Close() error
+}
+
+// i2cDevice is an i2cConn backed by an i2c-dev device file
+type i2cDevice struct {
+	file *os.File
+}
+
+// openI2C opens the i2c-dev device file and selects the chip address
+func openI2C(path string, addr uint16) (*i2cDevice, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open i2c device %s: %w", path, err)
+	}
+	err = unix.IoctlSetInt(int(file.Fd()), i2cSlave, int(addr))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to select i2c address 0x%02x on %s: %w", addr, path, err)
+	}
+	return &i2cDevice{file: file}, nil
+}
+
+// Write sends data to the chip in a single transaction
+func (obj *i2cDevice) Write(data []byte) error {
+	n, err := obj.file.Write(data)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("short i2c write, %d of %d bytes", n, len(data))
+	}
+	return nil
+}
+
+// Read fills data from the chip in a single transaction
+func (obj *i2cDevice) Read(data []byte) error {
+	n, err := obj.file.Read(data)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("short i2c read, %d of %d bytes", n, len(data))
+	}
+	return nil
+}
+
+// Close closes the device file
+func (obj *i2cDevice) Close() error {
+	return obj.file.Close()
+}
+
+// spiIocTransfer mirrors struct spi_ioc_transfer of linux/spi/spidev.h
+type spiIocTransfer struct {
+	txBuf       uint64
+	rxBuf       uint64
+	len         uint32
+	speedHz     uint32
+	delayUsecs  uint16
+	bitsPerWord uint8
+	csChange    uint8
+	txNbits     uint8
+	rxNbits     uint8
+	wordDelay   uint8
+	pad         uint8
+}
+
+// spiDevice is a spiConn backed by a spidev device file
+type spiDevice struct {
+	file    *os.File
+	speedHz uint32
+}
+
+// openSPI opens the spidev device file and sets the SPI mode
+func openSPI(path string, mode uint8, speedHz uint32) (*spiDevice, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spi device %s: %w", path, err)
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), spiIocWrMode, uintptr(unsafe.Pointer(&mode)))
+	if errno != 0 {
+		file.Close()
+		return nil, fmt.Errorf("failed to set spi mode %d on %s: %w", mode, path, errno)
+	}
+	return &spiDevice{file: file, speedHz: speedHz}, nil
+}
+
+// Transfer sends tx and receives the same number of bytes into rx while the chip is selected
+func (obj *spiDevice) Transfer(tx []byte, rx []byte) error {
+	if len(tx) != len(rx) || len(tx) == 0 {
+		return fmt.Errorf("invalid spi transfer length %d/%d", len(tx), len(rx))
+	}
+	xfer := spiIocTransfer{
+		txBuf:       uint64(uintptr(unsafe.Pointer(&tx[0]))),
+		rxBuf:       uint64(uintptr(unsafe.Pointer(&rx[0]))),
+		len:         uint32(len(tx)),
+		speedHz:     obj.speedHz,
+		bitsPerWord: 8,
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, obj.file.Fd(), spiIocMessage1, uintptr(unsafe.Pointer(&xfer)))
+	// the kernel accesses the buffers through the addresses in xfer only
+	runtime.KeepAlive(tx)
+	runtime.KeepAlive(rx)
+	if errno != 0 {
+		return fmt.Errorf("spi transfer failed: %w", errno)
+	}
+	return nil
+}
+
+// Close closes the device file
+func (obj *spiDevice) Close() error {
+	return obj.file.Close()
+}
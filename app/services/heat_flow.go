@@ -0,0 +1,105 @@
+package services
+
+import (
+	"fmt"
+	"rpi-heating-system/app/config"
+)
+
+// HeatFlowReading holds the values calculated from an inlet/outlet sensor pair
+type HeatFlowReading struct {
+	DeltaT   float64 // outlet minus inlet temperature
+	PowerKW  float64 // thermal power carried by the flow, valid only if HasPower is set
+	HasPower bool
+}
+
+// heatFlow is a single inlet/outlet sensor pair
+type heatFlow struct {
+	cfg    *config.HeatFlowConfig
+	pumpID PumpID
+}
+
+// HeatFlowService calculates temperature differences and thermal power of inlet/outlet sensor pairs
+type HeatFlowService struct {
+	tempReader TempSensorReader
+	pumpsSvc   PumpsService
+	flows      map[int]*heatFlow
+}
+
+// NewHeatFlowService creates a new HeatFlowService for all configured heat flow sensors
+func NewHeatFlowService(tempReader TempSensorReader, pumpsSvc PumpsService, conf *config.AppConfig) (*HeatFlowService, error) {
+
+	hf := &HeatFlowService{
+		tempReader: tempReader,
+		pumpsSvc:   pumpsSvc,
+		flows:      make(map[int]*heatFlow),
+	}
+
+	sensors := make(map[string]bool)
+	for _, sensor := range conf.TempSensors {
+		sensors[sensor.ID] = true
+	}
+	pumps := make(map[int]bool)
+	for _, pump := range conf.Pumps {
+		pumps[pump.ID] = true
+	}
+
+	for _, flow := range conf.HeatFlows {
+		if !sensors[flow.InletSensorID] || !sensors[flow.OutletSensorID] {
+			return nil, fmt.Errorf("heat flow %s sensors %s/%s do not exist", flow.Name, flow.InletSensorID, flow.OutletSensorID)
+		}
+		if flow.PumpID != 0 && !pumps[flow.PumpID] {
+			return nil, fmt.Errorf("heat flow %s pump %d does not exist", flow.Name, flow.PumpID)
+		}
+		if flow.FlowLitersPerMinute < 0 {
+			return nil, fmt.Errorf("heat flow %s flow rate must not be negative", flow.Name)
+		}
+		if _, ok := hf.flows[flow.ID]; ok {
+			return nil, fmt.Errorf("heat flow id %d is not unique", flow.ID)
+		}
+		hf.flows[flow.ID] = &heatFlow{
+			cfg:    flow,
+			pumpID: PumpID(flow.PumpID),
+		}
+	}
+
+	return hf, nil
+}
+
+// Calculate reads the inlet and outlet sensors of the heat flow with the specified ID
+func (obj *HeatFlowService) Calculate(id int) (HeatFlowReading, error) {
+	flow, ok := obj.flows[id]
+	if !ok {
+		return HeatFlowReading{}, fmt.Errorf("heat flow %d does not exist", id)
+	}
+
+	inlet, err := obj.tempReader.Read(flow.cfg.InletSensorID)
+	if err != nil {
+		return HeatFlowReading{}, fmt.Errorf("failed to read inlet sensor %s: %w", flow.cfg.InletSensorID, err)
+	}
+	outlet, err := obj.tempReader.Read(flow.cfg.OutletSensorID)
+	if err != nil {
+		return HeatFlowReading{}, fmt.Errorf("failed to read outlet sensor %s: %w", flow.cfg.OutletSensorID, err)
+	}
+
+	reading := HeatFlowReading{
+		DeltaT: outlet - inlet,
+	}
+	if flow.cfg.FlowLitersPerMinute == 0 {
+		return reading, nil
+	}
+
+	reading.HasPower = true
+	if flow.cfg.PumpID != 0 {
+		state, err := obj.pumpsSvc.GetPumpState(flow.pumpID)
+		if err != nil {
+			return HeatFlowReading{}, fmt.Errorf("failed to get pump %d state: %w", flow.pumpID, err)
+		}
+		// no circulation, no heat transport
+		if state == PumpOFF {
+			return reading, nil
+		}
+	}
+	// kg/s * kJ/(kg*K) * K = kW
+	reading.PowerKW = flow.cfg.FlowLitersPerMinute / 60 * waterHeatCapacity * reading.DeltaT
+	return reading, nil
+}
@@ -1,9 +1,12 @@
 package services
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"rpi-heating-system/app/config"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/warthog618/gpiod"
@@ -25,45 +28,164 @@ func (ps PumpState) Value() int {
 	return int(ps)
 }
 
+// PumpStateObserver is called after the state of a pump has changed
+type PumpStateObserver func(pump PumpID, state PumpState)
+
 // PumpsService is an interface that defines the operations for controlling pumps
 // It provides methods to set and get the state of a pump and also implements the io.Closer interface for cleanup
 type PumpsService interface {
 	SetPumpState(pump PumpID, state PumpState) error
+	// ForcePumpState sets the pump state immediately, bypassing the anti-short-cycling limits
+	// It is reserved for safety rules
+	ForcePumpState(pump PumpID, state PumpState) error
 	GetPumpState(pump PumpID) (PumpState, error)
+	// AddStateObserver registers an observer that is notified about every pump state change, whoever made it
+	AddStateObserver(observer PumpStateObserver)
+	// GetPumpStats returns the runtime accounting of the pump, including the current ON period
+	GetPumpStats(pump PumpID) (PumpStats, error)
 	io.Closer
 }
 
+// ErrSwitchRejected is returned when a pump switch would exceed the maximum number of switches per hour
+var ErrSwitchRejected = errors.New("too many switches per hour")
+
+// SwitchDelayedError is returned when a pump switch is postponed because of the minimum on/off time
+// The switch is applied automatically at Until unless another state is requested before
+type SwitchDelayedError struct {
+	PumpID PumpID
+	State  PumpState
+	Until  time.Time
+}
+
+// Error returns the error message
+func (e *SwitchDelayedError) Error() string {
+	return fmt.Sprintf("pump %d switch to state %d delayed until %s", e.PumpID, e.State.Value(), e.Until.Format(time.RFC3339))
+}
+
+// pendingSwitch is a delayed pump switch waiting for the minimum on/off time to elapse
+type pendingSwitch struct {
+	state PumpState
+	timer *time.Timer
+}
+
+// statsSaveInterval is the interval for persisting pump statistics while pumps are running
+const statsSaveInterval = 5 * time.Minute
+
+// heatingPump holds the GPIO line, anti-short-cycling bookkeeping and accounting of a single pump
+type heatingPump struct {
+	line       *gpiod.Line
+	cfg        *config.PumpConfig
+	lastSwitch time.Time
+	switches   []time.Time // switch timestamps within the last hour
+	pending    *pendingSwitch
+	stats      *PumpStats
+	on         bool
+	accruedAt  time.Time // time until which the runtime and energy are accounted
+}
+
+// accrue adds the ON time since the last accounting to the runtime and energy counters
+func (p *heatingPump) accrue(now time.Time) {
+	if p.on {
+		elapsed := now.Sub(p.accruedAt)
+		p.stats.RuntimeSeconds += elapsed.Seconds()
+		p.stats.EnergyKWh += p.cfg.RatedWatts * elapsed.Hours() / 1000
+	}
+	p.accruedAt = now
+}
+
+// cancelPending stops the delayed switch if there is one
+func (p *heatingPump) cancelPending() {
+	if p.pending != nil {
+		p.pending.timer.Stop()
+		p.pending = nil
+	}
+}
+
+// switchesLastHour drops switch timestamps older than one hour and returns the number of remaining ones
+func (p *heatingPump) switchesLastHour(now time.Time) int {
+	i := 0
+	for i < len(p.switches) && now.Sub(p.switches[i]) >= time.Hour {
+		i++
+	}
+	p.switches = p.switches[i:]
+	return len(p.switches)
+}
+
 // HeatingPumpsHandler represents a handler for controlling pumps using GPIO lines
 // It implements the PumpsService interface for pump control and cleanup.
+// Switching is limited by the minimum on/off time and maximum switches per hour of each pump.
 type HeatingPumpsHandler struct {
-	pumps map[PumpID]*gpiod.Line
+	mu        sync.Mutex
+	pumps     map[PumpID]*heatingPump
+	observers []PumpStateObserver
+	statsPath string
+	ticker    *time.Ticker
 }
 
 // NewHAHeatingHeatingPumpsHandler creates a new HeatingPumpsHandler with the given GPIO configuration and pump configurations
 // It requests GPIO lines for each pump and initializes the HeatingPumpsHandler with these lines
-func NewHeatingPumpsHandler(gpiodChip *gpiod.Chip, pumpsCfg []*config.PumpConfig) (*HeatingPumpsHandler, error) {
+// Pump statistics are loaded from and persisted to statsPath, an empty path keeps them in memory only
+func NewHeatingPumpsHandler(gpiodChip *gpiod.Chip, pumpsCfg []*config.PumpConfig, statsPath string) (*HeatingPumpsHandler, error) {
 
 	ph := &HeatingPumpsHandler{
-		pumps: make(map[PumpID]*gpiod.Line),
+		pumps:     make(map[PumpID]*heatingPump),
+		statsPath: statsPath,
+	}
+
+	stats := make(map[PumpID]*PumpStats)
+	if statsPath != "" {
+		var err error
+		stats, err = loadPumpStats(statsPath)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	var err error
 	for _, pump := range pumpsCfg {
-		ph.pumps[PumpID(pump.ID)], err = gpiodChip.RequestLine(
+		line, err := gpiodChip.RequestLine(
 			pump.GpioStatePin,
 			gpiod.AsOutput(0),
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to request %s GPIO line %d: %w", pump.Name, pump.GpioStatePin, err)
 		}
+		pumpStats, ok := stats[PumpID(pump.ID)]
+		if !ok {
+			pumpStats = &PumpStats{}
+		}
+		ph.pumps[PumpID(pump.ID)] = &heatingPump{
+			line:  line,
+			cfg:   pump,
+			stats: pumpStats,
+		}
 	}
+
+	ph.ticker = time.NewTicker(statsSaveInterval)
+	go func() {
+		for range ph.ticker.C {
+			err := ph.saveStats()
+			if err != nil {
+				log.Error().Msgf("failed to save pump stats: %s", err)
+			}
+		}
+	}()
+
 	return ph, nil
 }
 
-// Close closes the GPIO lines for all the pumps
+// Close saves the pump statistics and closes the GPIO lines for all the pumps
 func (obj *HeatingPumpsHandler) Close() error {
-	for _, line := range obj.pumps {
-		err := line.Close()
+	obj.ticker.Stop()
+	err := obj.saveStats()
+	if err != nil {
+		log.Error().Msgf("failed to save pump stats: %s", err)
+	}
+
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	for _, pump := range obj.pumps {
+		pump.cancelPending()
+		err := pump.line.Close()
 		if err != nil {
 			return fmt.Errorf("failed to close gpio line: %w", err)
 		}
@@ -71,28 +193,169 @@ func (obj *HeatingPumpsHandler) Close() error {
 	return nil
 }
 
+// AddStateObserver registers an observer that is notified about every pump state change
+func (obj *HeatingPumpsHandler) AddStateObserver(observer PumpStateObserver) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.observers = append(obj.observers, observer)
+}
+
 // SetPumpState sets the state of the pump with the specified ID
+// If the minimum on/off time has not elapsed yet the switch is delayed and a SwitchDelayedError is returned,
+// if the maximum number of switches per hour is reached an error wrapping ErrSwitchRejected is returned
 func (obj *HeatingPumpsHandler) SetPumpState(pumpID PumpID, state PumpState) error {
+	return obj.setPumpState(pumpID, state, false)
+}
+
+// ForcePumpState sets the state of the pump with the specified ID without applying anti-short-cycling limits
+func (obj *HeatingPumpsHandler) ForcePumpState(pumpID PumpID, state PumpState) error {
+	return obj.setPumpState(pumpID, state, true)
+}
+
+// setPumpState cancels a delayed switch of the pump and switches it, optionally bypassing the limits
+func (obj *HeatingPumpsHandler) setPumpState(pumpID PumpID, state PumpState, force bool) error {
+	obj.mu.Lock()
 	p, ok := obj.pumps[pumpID]
 	if !ok {
+		obj.mu.Unlock()
 		return fmt.Errorf("pump %d does not exist", pumpID)
 	}
 	log.Debug().Msgf("Setting pump state, ID %d, state %d", pumpID, state.Value())
 
-	err := p.SetValue(state.Value())
+	// the latest request always replaces a delayed one
+	p.cancelPending()
+	changed, err := obj.switchPump(pumpID, p, state, force)
+	obj.mu.Unlock()
+
+	if changed {
+		obj.notifyObservers(pumpID, state)
+	}
+	return err
+}
+
+// switchPump applies the anti-short-cycling limits unless forced and switches the GPIO line, the lock must be held
+// It returns true if the pump state has been changed
+func (obj *HeatingPumpsHandler) switchPump(pumpID PumpID, p *heatingPump, state PumpState, force bool) (bool, error) {
+	val, err := p.line.Value()
 	if err != nil {
-		return fmt.Errorf("failed to set pump state")
+		return false, fmt.Errorf("failed to get pump state")
 	}
-	return nil
+	if PumpState(val) == state {
+		return false, nil
+	}
+
+	now := time.Now()
+	// forced switches are still counted so the limits apply to the switches that follow
+	p.switchesLastHour(now)
+	if force {
+		log.Warn().Msgf("Forcing pump %d state %d", pumpID, state.Value())
+	} else if p.cfg.MaxSwitchesPerHour > 0 && len(p.switches) >= p.cfg.MaxSwitchesPerHour {
+		log.Warn().Msgf("Pump %d switch to state %d rejected, %d switches in the last hour", pumpID, state.Value(), len(p.switches))
+		return false, fmt.Errorf("pump %d switch rejected: %w", pumpID, ErrSwitchRejected)
+	}
+
+	// the pump has to stay in its current state for the minimum time of that state
+	minDuration := time.Duration(p.cfg.MinOffSeconds) * time.Second
+	if state == PumpOFF {
+		minDuration = time.Duration(p.cfg.MinOnSeconds) * time.Second
+	}
+	allowedAt := p.lastSwitch.Add(minDuration)
+	if !force && now.Before(allowedAt) {
+		pending := &pendingSwitch{state: state}
+		pending.timer = time.AfterFunc(allowedAt.Sub(now), func() {
+			obj.applyPending(pumpID, pending)
+		})
+		p.pending = pending
+		log.Info().Msgf("Pump %d switch to state %d delayed until %s", pumpID, state.Value(), allowedAt.Format(time.RFC3339))
+		return false, &SwitchDelayedError{PumpID: pumpID, State: state, Until: allowedAt}
+	}
+
+	err = p.line.SetValue(state.Value())
+	if err != nil {
+		return false, fmt.Errorf("failed to set pump state")
+	}
+	p.lastSwitch = now
+	p.switches = append(p.switches, now)
+
+	p.accrue(now)
+	p.on = state == PumpON
+	if p.on {
+		p.stats.Starts++
+		p.stats.LastOn = now
+	} else {
+		p.stats.LastOff = now
+	}
+	return true, nil
+}
+
+// applyPending applies a delayed switch unless it has been replaced or cancelled in the meantime
+func (obj *HeatingPumpsHandler) applyPending(pumpID PumpID, pending *pendingSwitch) {
+	obj.mu.Lock()
+	p := obj.pumps[pumpID]
+	if p.pending != pending {
+		obj.mu.Unlock()
+		return
+	}
+	p.pending = nil
+	changed, err := obj.switchPump(pumpID, p, pending.state, false)
+	obj.mu.Unlock()
+
+	if err != nil {
+		log.Error().Msgf("failed to apply delayed pump %d switch: %s", pumpID, err)
+	}
+	if changed {
+		obj.notifyObservers(pumpID, pending.state)
+	}
+}
+
+// notifyObservers calls all registered observers with the new pump state
+func (obj *HeatingPumpsHandler) notifyObservers(pumpID PumpID, state PumpState) {
+	obj.mu.Lock()
+	observers := obj.observers
+	obj.mu.Unlock()
+	for _, observer := range observers {
+		observer(pumpID, state)
+	}
+}
+
+// GetPumpStats returns the runtime accounting of the pump with the specified ID
+func (obj *HeatingPumpsHandler) GetPumpStats(pumpID PumpID) (PumpStats, error) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	p, ok := obj.pumps[pumpID]
+	if !ok {
+		return PumpStats{}, fmt.Errorf("pump %d does not exist", pumpID)
+	}
+	p.accrue(time.Now())
+	return *p.stats, nil
+}
+
+// saveStats persists the statistics of all pumps if a stats path is configured
+func (obj *HeatingPumpsHandler) saveStats() error {
+	if obj.statsPath == "" {
+		return nil
+	}
+	now := time.Now()
+	obj.mu.Lock()
+	stats := make(map[PumpID]*PumpStats, len(obj.pumps))
+	for id, p := range obj.pumps {
+		p.accrue(now)
+		pumpStats := *p.stats
+		stats[id] = &pumpStats
+	}
+	obj.mu.Unlock()
+	return savePumpStats(obj.statsPath, stats)
 }
 
 // GetPumpState returns the current state of the pump with the specified ID
 func (obj *HeatingPumpsHandler) GetPumpState(pumpID PumpID) (PumpState, error) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
 	p, ok := obj.pumps[pumpID]
 	if !ok {
 		return 0, fmt.Errorf("pump %d does not exist", pumpID)
 	}
-	val, err := p.Value()
+	val, err := p.line.Value()
 	if err != nil {
 		return 0, fmt.Errorf("failed to get pump state")
 	}
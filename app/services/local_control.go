@@ -0,0 +1,195 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"rpi-heating-system/app/config"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultLocalControlInterval = 30 * time.Second
+	defaultHATimeout            = 30 * time.Minute
+)
+
+// ControlMode represents the source that is currently in charge of the pumps
+type ControlMode string
+
+const (
+	ControlModeHA    ControlMode = "home_assistant" // ControlModeHA indicates pumps are driven by Home Assistant commands.
+	ControlModeLocal ControlMode = "local"          // ControlModeLocal indicates pumps are driven by local thermostats.
+)
+
+// ControlModeObserver is called after the control mode has changed
+type ControlModeObserver func(mode ControlMode)
+
+// LocalControlService drives pumps with local thermostats when Home Assistant stops sending commands
+// It takes over after the configured timeout without commands and hands control back on the next command
+type LocalControlService struct {
+	pumpsSvc      PumpsService
+	tempReader    TempSensorReader
+	thermostats   map[PumpID]*config.ThermostatConfig
+	haTimeout     time.Duration
+	ticker        *time.Ticker
+	mu            sync.Mutex
+	mode          ControlMode
+	lastHACommand time.Time
+	observers     []ControlModeObserver
+}
+
+// NewLocalControlService creates a new LocalControlService and starts evaluating local thermostats periodically
+func NewLocalControlService(
+	pumpsSvc PumpsService,
+	tempReader TempSensorReader,
+	conf *config.AppConfig,
+) (*LocalControlService, error) {
+
+	lc := &LocalControlService{
+		pumpsSvc:      pumpsSvc,
+		tempReader:    tempReader,
+		thermostats:   make(map[PumpID]*config.ThermostatConfig),
+		haTimeout:     defaultHATimeout,
+		mode:          ControlModeHA,
+		lastHACommand: time.Now(),
+	}
+
+	sensors := make(map[string]bool)
+	for _, sensor := range conf.TempSensors {
+		sensors[sensor.ID] = true
+	}
+	for _, pump := range conf.Pumps {
+		if pump.Thermostat == nil {
+			continue
+		}
+		if !sensors[pump.Thermostat.SensorID] {
+			return nil, fmt.Errorf("pump %s local thermostat sensor %s does not exist", pump.Name, pump.Thermostat.SensorID)
+		}
+		if pump.Thermostat.Hysteresis < 0 {
+			return nil, fmt.Errorf("pump %s local thermostat hysteresis must not be negative", pump.Name)
+		}
+		lc.thermostats[PumpID(pump.ID)] = pump.Thermostat
+	}
+
+	interval := defaultLocalControlInterval
+	if conf.LocalCtl != nil {
+		if conf.LocalCtl.HATimeout > 0 {
+			lc.haTimeout = time.Duration(conf.LocalCtl.HATimeout) * time.Second
+		}
+		if conf.LocalCtl.Interval > 0 {
+			interval = time.Duration(conf.LocalCtl.Interval) * time.Second
+		}
+	}
+
+	lc.ticker = time.NewTicker(interval)
+	go func() {
+		for range lc.ticker.C {
+			lc.evaluate()
+		}
+	}()
+
+	return lc, nil
+}
+
+// Close stops the local control loop, pumps are left in their current state
+func (obj *LocalControlService) Close() error {
+	obj.ticker.Stop()
+	return nil
+}
+
+// Mode returns the currently active control mode
+func (obj *LocalControlService) Mode() ControlMode {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	return obj.mode
+}
+
+// AddModeObserver registers an observer that is notified about every control mode change
+func (obj *LocalControlService) AddModeObserver(observer ControlModeObserver) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.observers = append(obj.observers, observer)
+}
+
+// NotifyHACommand records that Home Assistant is alive and hands control back to it if local control was active
+func (obj *LocalControlService) NotifyHACommand() {
+	obj.mu.Lock()
+	obj.lastHACommand = time.Now()
+	obj.mu.Unlock()
+	obj.setMode(ControlModeHA)
+}
+
+// evaluate switches to local mode after the Home Assistant timeout and runs the local thermostats
+func (obj *LocalControlService) evaluate() {
+	obj.mu.Lock()
+	silence := time.Since(obj.lastHACommand)
+	obj.mu.Unlock()
+
+	if silence < obj.haTimeout {
+		return
+	}
+	obj.setMode(ControlModeLocal)
+
+	for pumpID, thermostat := range obj.thermostats {
+		err := obj.runThermostat(pumpID, thermostat)
+		if err != nil {
+			log.Error().Msgf("local thermostat for pump %d failed: %s", pumpID, err)
+		}
+	}
+}
+
+// runThermostat sets the pump state based on the linked sensor temperature
+// Inside the hysteresis band the pump state is left unchanged
+func (obj *LocalControlService) runThermostat(pumpID PumpID, thermostat *config.ThermostatConfig) error {
+	temp, err := obj.tempReader.Read(thermostat.SensorID)
+	if err != nil {
+		return fmt.Errorf("failed to read sensor %s: %w", thermostat.SensorID, err)
+	}
+
+	turnOn := temp < thermostat.Setpoint-thermostat.Hysteresis
+	turnOff := temp >= thermostat.Setpoint
+	if thermostat.OnAbove {
+		turnOn = temp > thermostat.Setpoint+thermostat.Hysteresis
+		turnOff = temp <= thermostat.Setpoint
+	}
+
+	switch {
+	case turnOn:
+		err = obj.pumpsSvc.SetPumpState(pumpID, PumpON)
+	case turnOff:
+		err = obj.pumpsSvc.SetPumpState(pumpID, PumpOFF)
+	}
+	// a delayed switch is applied as soon as the minimum on/off time elapses
+	var delayedErr *SwitchDelayedError
+	if errors.As(err, &delayedErr) {
+		return nil
+	}
+	// safety rules and manual overrides take precedence over local thermostats
+	if errors.Is(err, ErrPumpInterlocked) || errors.Is(err, ErrPumpOverridden) {
+		return nil
+	}
+	return err
+}
+
+// setMode changes the control mode and notifies observers if it differs from the current one
+func (obj *LocalControlService) setMode(mode ControlMode) {
+	obj.mu.Lock()
+	if obj.mode == mode {
+		obj.mu.Unlock()
+		return
+	}
+	obj.mode = mode
+	observers := obj.observers
+	obj.mu.Unlock()
+
+	if mode == ControlModeLocal {
+		log.Warn().Msgf("No Home Assistant commands for %s, local thermostats took over", obj.haTimeout)
+	} else {
+		log.Info().Msg("Home Assistant is back in control")
+	}
+	for _, observer := range observers {
+		observer(mode)
+	}
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"rpi-heating-system/app/config"
+	"time"
+)
+
+const (
+	// max31865 registers, the write address has the MSB set
+	max31865RegConfig = 0x00
+	max31865RegRTD    = 0x01
+	max31865RegFault  = 0x07
+	max31865WriteBit  = 0x80
+
+	// max31865 configuration bits
+	max31865Bias      = 0x80
+	max31865OneShot   = 0x20
+	max31865ThreeWire = 0x10
+	max31865FaultClr  = 0x02
+	max31865Filter50  = 0x01
+
+	// Callendar-Van Dusen coefficients of platinum RTDs
+	rtdA = 3.9083e-3
+	rtdB = -5.775e-7
+
+	defaultMAX31865Speed = 500000
+)
+
+// max31865Driver reads a PT100/PT1000 RTD through a MAX31865 converter on spidev
+type max31865Driver struct {
+	conn     spiConn
+	device   string
+	rNominal float64
+	rRef     float64
+	config   byte
+}
+
+// newMAX31865Driver creates a MAX31865 driver from the sensor config
+func newMAX31865Driver(sensor *config.TempSensorsConfig) (TempDriver, error) {
+	cfg := sensor.MAX31865
+	if cfg == nil {
+		cfg = &config.MAX31865Config{}
+	}
+	speed := cfg.SpeedHz
+	if speed == 0 {
+		speed = defaultMAX31865Speed
+	}
+	// the MAX31865 supports SPI modes 1 and 3
+	conn, err := openSPI(sensor.Device, 1, speed)
+	if err != nil {
+		return nil, err
+	}
+	return newMAX31865(conn, sensor.Device, cfg)
+}
+
+// newMAX31865 creates a MAX31865 driver on an open connection
+func newMAX31865(conn spiConn, device string, cfg *config.MAX31865Config) (*max31865Driver, error) {
+	d := &max31865Driver{
+		conn:     conn,
+		device:   device,
+		rNominal: cfg.RNominal,
+		rRef:     cfg.RRef,
+	}
+	if d.rNominal == 0 {
+		d.rNominal = 100
+	}
+	if d.rRef == 0 {
+		d.rRef = 430
+	}
+	switch cfg.Wires {
+	case 0, 2, 4:
+	case 3:
+		d.config |= max31865ThreeWire
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("max31865 on %s: unsupported %d wire RTD", device, cfg.Wires)
+	}
+	if cfg.Filter50Hz {
+		d.config |= max31865Filter50
+	}
+	return d, nil
+}
+
+// Read runs a one-shot conversion and returns the RTD temperature in °C
+// The bias voltage is only on during the conversion to limit self-heating
+func (obj *max31865Driver) Read() (float64, error) {
+	lock := deviceLock(obj.device)
+	lock.Lock()
+	defer lock.Unlock()
+
+	err := obj.writeRegister(max31865RegConfig, obj.config|max31865Bias|max31865FaultClr)
+	if err != nil {
+		return 0.0, err
+	}
+	// bias voltage settling time
+	time.Sleep(10 * time.Millisecond)
+	err = obj.writeRegister(max31865RegConfig, obj.config|max31865Bias|max31865OneShot)
+	if err != nil {
+		return 0.0, err
+	}
+	// one-shot conversion takes 52 ms with the 60 Hz filter and 62.5 ms with the 50 Hz one
+	time.Sleep(65 * time.Millisecond)
+
+	rx, err := obj.readRegisters(max31865RegRTD, 2)
+	if err != nil {
+		return 0.0, err
+	}
+	err = obj.writeRegister(max31865RegConfig, obj.config)
+	if err != nil {
+		return 0.0, err
+	}
+
+	code := uint16(rx[0])<<8 | uint16(rx[1])
+	if code&0x01 != 0 {
+		fault, err := obj.readRegisters(max31865RegFault, 1)
+		if err != nil {
+			return 0.0, err
+		}
+		return 0.0, fmt.Errorf("max31865 on %s reported fault 0x%02x: %w", obj.device, fault[0], ErrOutOfRange)
+	}
+
+	resistance := float64(code>>1) * obj.rRef / 32768
+	temp, err := rtdTemperature(resistance, obj.rNominal)
+	if err != nil {
+		return 0.0, fmt.Errorf("max31865 on %s: %w", obj.device, err)
+	}
+	return temp, nil
+}
+
+// Close closes the SPI device
+func (obj *max31865Driver) Close() error {
+	return obj.conn.Close()
+}
+
+// writeRegister writes a single register
+func (obj *max31865Driver) writeRegister(reg byte, value byte) error {
+	rx := make([]byte, 2)
+	err := obj.conn.Transfer([]byte{reg | max31865WriteBit, value}, rx)
+	if err != nil {
+		return fmt.Errorf("failed to write max31865 register 0x%02x on %s: %w", reg, obj.device, err)
+	}
+	return nil
+}
+
+// readRegisters reads n consecutive registers starting at reg
+func (obj *max31865Driver) readRegisters(reg byte, n int) ([]byte, error) {
+	tx := make([]byte, n+1)
+	tx[0] = reg
+	rx := make([]byte, n+1)
+	err := obj.conn.Transfer(tx, rx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read max31865 register 0x%02x on %s: %w", reg, obj.device, err)
+	}
+	return rx[1:], nil
+}
+
+// rtdTemperature converts the RTD resistance to °C with the Callendar-Van Dusen equation
+// The quadratic form is exact above 0 °C, below 0 °C the error stays under 0.1 °C down to -50 °C
+func rtdTemperature(resistance float64, rNominal float64) (float64, error) {
+	z := rtdA*rtdA - 4*rtdB*(1-resistance/rNominal)
+	if z < 0 {
+		return 0.0, fmt.Errorf("rtd resistance %.2f ohm has no temperature: %w", resistance, ErrOutOfRange)
+	}
+	return (-rtdA + math.Sqrt(z)) / (2 * rtdB), nil
+}
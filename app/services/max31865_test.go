@@ -0,0 +1,136 @@
+package services
+
+import (
+	"errors"
+	"math"
+	"rpi-heating-system/app/config"
+	"strings"
+	"testing"
+)
+
+// fakeMAX31865 is a spiConn emulating the MAX31865 register file
+type fakeMAX31865 struct {
+	regs   [8]byte
+	writes [][2]byte // register and value of every write
+	reads  []byte    // first register of every read
+	closed bool
+}
+
+func (obj *fakeMAX31865) Transfer(tx []byte, rx []byte) error {
+	reg := tx[0] &^ max31865WriteBit
+	if tx[0]&max31865WriteBit != 0 {
+		obj.writes = append(obj.writes, [2]byte{reg, tx[1]})
+		obj.regs[reg] = tx[1]
+		return nil
+	}
+	obj.reads = append(obj.reads, reg)
+	for i := 1; i < len(rx); i++ {
+		rx[i] = obj.regs[int(reg)+i-1]
+	}
+	return nil
+}
+
+func (obj *fakeMAX31865) Close() error {
+	obj.closed = true
+	return nil
+}
+
+// setResistance stores the RTD code of the resistance measured against rRef
+func (obj *fakeMAX31865) setResistance(resistance float64, rRef float64) {
+	code := uint16(math.Round(resistance/rRef*32768)) << 1
+	obj.regs[max31865RegRTD] = byte(code >> 8)
+	obj.regs[max31865RegRTD+1] = byte(code)
+}
+
+func TestMAX31865Read(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        config.MAX31865Config
+		resistance float64
+		temp       float64
+		config     byte // expected configuration without bias, one-shot and fault clear bits
+	}{
+		{"PT100 at 0 °C", config.MAX31865Config{}, 100, 0, 0},
+		{"PT100 at 100 °C", config.MAX31865Config{}, 138.5055, 100, 0},
+		{"PT100 3 wire 50 Hz", config.MAX31865Config{Wires: 3, Filter50Hz: true}, 119.397, 50, max31865ThreeWire | max31865Filter50},
+		{"PT1000 at 100 °C", config.MAX31865Config{RNominal: 1000, RRef: 4300}, 1385.055, 100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rRef := tt.cfg.RRef
+			if rRef == 0 {
+				rRef = 430
+			}
+			conn := &fakeMAX31865{}
+			conn.setResistance(tt.resistance, rRef)
+			d, err := newMAX31865(conn, "spidev-test", &tt.cfg)
+			if err != nil {
+				t.Fatalf("newMAX31865: %s", err)
+			}
+			temp, err := d.Read()
+			if err != nil {
+				t.Fatalf("Read: %s", err)
+			}
+			if math.Abs(temp-tt.temp) > 0.05 {
+				t.Errorf("temperature = %.3f °C, want %.3f °C", temp, tt.temp)
+			}
+
+			// bias with fault clear, one-shot conversion, bias off again
+			want := [][2]byte{
+				{max31865RegConfig, tt.config | max31865Bias | max31865FaultClr},
+				{max31865RegConfig, tt.config | max31865Bias | max31865OneShot},
+				{max31865RegConfig, tt.config},
+			}
+			if len(conn.writes) != len(want) {
+				t.Fatalf("writes = %x, want %x", conn.writes, want)
+			}
+			for i := range want {
+				if conn.writes[i] != want[i] {
+					t.Errorf("write %d = %x, want %x", i, conn.writes[i], want[i])
+				}
+			}
+			if len(conn.reads) != 1 || conn.reads[0] != max31865RegRTD {
+				t.Errorf("reads = %x, want only the RTD register", conn.reads)
+			}
+		})
+	}
+}
+
+func TestMAX31865Fault(t *testing.T) {
+	conn := &fakeMAX31865{}
+	conn.setResistance(100, 430)
+	conn.regs[max31865RegRTD+1] |= 0x01
+	conn.regs[max31865RegFault] = 0x84
+	d, err := newMAX31865(conn, "spidev-test", &config.MAX31865Config{})
+	if err != nil {
+		t.Fatalf("newMAX31865: %s", err)
+	}
+	_, err = d.Read()
+	if !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("Read error = %v, want ErrOutOfRange", err)
+	}
+	if !strings.Contains(err.Error(), "0x84") {
+		t.Errorf("Read error %q does not report the fault register", err)
+	}
+	if conn.reads[len(conn.reads)-1] != max31865RegFault {
+		t.Errorf("fault register was not read, reads = %x", conn.reads)
+	}
+}
+
+func TestMAX31865InvalidWires(t *testing.T) {
+	conn := &fakeMAX31865{}
+	_, err := newMAX31865(conn, "spidev-test", &config.MAX31865Config{Wires: 5})
+	if err == nil {
+		t.Fatal("newMAX31865 accepted a 5 wire RTD")
+	}
+	if !conn.closed {
+		t.Error("connection was not closed")
+	}
+}
+
+func TestRTDTemperatureOutOfRange(t *testing.T) {
+	_, err := rtdTemperature(800, 100)
+	if !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("rtdTemperature error = %v, want ErrOutOfRange", err)
+	}
+}
@@ -0,0 +1,255 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"rpi-heating-system/app/config"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultOverrideDuration is used for pumps without override_minutes
+const defaultOverrideDuration = 60 * time.Minute
+
+// ErrPumpOverridden is returned when a pump command arrives while a manual override is active
+// The command is remembered and applied once the override ends
+var ErrPumpOverridden = errors.New("pump is in manual override")
+
+// PumpOverride describes an active manual override of a pump
+type PumpOverride struct {
+	State PumpState
+	Until time.Time
+}
+
+// OverrideObserver is called after an override has been started or has ended, override is nil once it ended
+type OverrideObserver func(pumpID PumpID, override *PumpOverride)
+
+// activeOverride is an override with its expiry timer
+type activeOverride struct {
+	PumpOverride
+	timer *time.Timer
+}
+
+// OverrideService is a PumpsService layer that lets manual overrides take precedence over automatic control
+// While a pump is overridden commands of Home Assistant and local thermostats are refused with ErrPumpOverridden.
+// The last refused command is remembered, so control returns to whichever source was in charge once the override ends.
+type OverrideService struct {
+	pumpsSvc  PumpsService
+	durations map[PumpID]time.Duration
+	mu        sync.Mutex
+	overrides map[PumpID]*activeOverride
+	requested map[PumpID]PumpState // last state requested through this layer
+	observers []OverrideObserver
+	closed    bool
+}
+
+// NewOverrideService creates a new OverrideService wrapping the given PumpsService
+func NewOverrideService(pumpsSvc PumpsService, conf *config.AppConfig) *OverrideService {
+	ov := &OverrideService{
+		pumpsSvc:  pumpsSvc,
+		durations: make(map[PumpID]time.Duration),
+		overrides: make(map[PumpID]*activeOverride),
+		requested: make(map[PumpID]PumpState),
+	}
+	for _, pump := range conf.Pumps {
+		duration := defaultOverrideDuration
+		if pump.OverrideMinutes > 0 {
+			duration = time.Duration(pump.OverrideMinutes) * time.Minute
+		}
+		ov.durations[PumpID(pump.ID)] = duration
+	}
+	return ov
+}
+
+// DefaultDuration returns the configured override duration of the pump
+func (obj *OverrideService) DefaultDuration(pumpID PumpID) time.Duration {
+	duration, ok := obj.durations[pumpID]
+	if !ok {
+		return defaultOverrideDuration
+	}
+	return duration
+}
+
+// Override forces the pump to the state for the duration, replacing an active override of the pump
+// The override is registered before the pump is switched, so no command can slip in between,
+// and rolled back if the switch fails
+func (obj *OverrideService) Override(pumpID PumpID, state PumpState, duration time.Duration) error {
+	if duration <= 0 {
+		return fmt.Errorf("pump %d override duration must be positive", pumpID)
+	}
+	obj.mu.Lock()
+	if obj.closed {
+		obj.mu.Unlock()
+		return fmt.Errorf("override service is closed")
+	}
+	old, replaced := obj.overrides[pumpID]
+	// the state before the first override is the fallback if no command arrives meanwhile
+	if _, ok := obj.requested[pumpID]; !ok && !replaced {
+		current, err := obj.pumpsSvc.GetPumpState(pumpID)
+		if err != nil {
+			obj.mu.Unlock()
+			return err
+		}
+		obj.requested[pumpID] = current
+	}
+	o := &activeOverride{PumpOverride: PumpOverride{State: state, Until: time.Now().Add(duration)}}
+	o.timer = time.AfterFunc(duration, func() {
+		obj.expire(pumpID, o)
+	})
+	obj.overrides[pumpID] = o
+	if replaced {
+		old.timer.Stop()
+	}
+	obj.mu.Unlock()
+
+	err := obj.pumpsSvc.SetPumpState(pumpID, state)
+	var delayedErr *SwitchDelayedError
+	if err != nil && !errors.As(err, &delayedErr) {
+		obj.rollback(pumpID, o, old)
+		return err
+	}
+
+	obj.mu.Lock()
+	observers := obj.observers
+	obj.mu.Unlock()
+
+	log.Info().Msgf("Pump %d overridden %s until %s", pumpID, stateName(state), o.Until.Format(time.RFC3339))
+	override := o.PumpOverride
+	for _, observer := range observers {
+		observer(pumpID, &override)
+	}
+	return nil
+}
+
+// rollback removes an override whose switch failed and reinstates the override it replaced, if any
+func (obj *OverrideService) rollback(pumpID PumpID, o *activeOverride, old *activeOverride) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	o.timer.Stop()
+	if obj.closed || obj.overrides[pumpID] != o {
+		return
+	}
+	if old == nil {
+		delete(obj.overrides, pumpID)
+		return
+	}
+	old.timer = time.AfterFunc(time.Until(old.Until), func() {
+		obj.expire(pumpID, old)
+	})
+	obj.overrides[pumpID] = old
+}
+
+// Cancel ends the override of the pump and hands control back to the last requested state
+func (obj *OverrideService) Cancel(pumpID PumpID) error {
+	obj.mu.Lock()
+	o, ok := obj.overrides[pumpID]
+	if ok {
+		o.timer.Stop()
+	}
+	obj.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return obj.end(pumpID, o)
+}
+
+// ActiveOverride returns the active override of the pump
+func (obj *OverrideService) ActiveOverride(pumpID PumpID) (PumpOverride, bool) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	o, ok := obj.overrides[pumpID]
+	if !ok {
+		return PumpOverride{}, false
+	}
+	return o.PumpOverride, true
+}
+
+// AddOverrideObserver registers an observer that is notified when an override is started or ends
+func (obj *OverrideService) AddOverrideObserver(observer OverrideObserver) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.observers = append(obj.observers, observer)
+}
+
+// SetPumpState sets the pump state unless the pump is overridden
+func (obj *OverrideService) SetPumpState(pumpID PumpID, state PumpState) error {
+	obj.mu.Lock()
+	obj.requested[pumpID] = state
+	_, overridden := obj.overrides[pumpID]
+	obj.mu.Unlock()
+
+	if overridden {
+		log.Info().Msgf("Pump %d command %s remembered, manual override is active", pumpID, stateName(state))
+		return fmt.Errorf("pump %d: %w", pumpID, ErrPumpOverridden)
+	}
+	return obj.pumpsSvc.SetPumpState(pumpID, state)
+}
+
+// ForcePumpState sets the pump state immediately, bypassing the anti-short-cycling limits
+func (obj *OverrideService) ForcePumpState(pumpID PumpID, state PumpState) error {
+	return obj.pumpsSvc.ForcePumpState(pumpID, state)
+}
+
+// GetPumpState returns the current state of the pump
+func (obj *OverrideService) GetPumpState(pumpID PumpID) (PumpState, error) {
+	return obj.pumpsSvc.GetPumpState(pumpID)
+}
+
+// GetPumpStats returns the runtime accounting of the pump
+func (obj *OverrideService) GetPumpStats(pumpID PumpID) (PumpStats, error) {
+	return obj.pumpsSvc.GetPumpStats(pumpID)
+}
+
+// AddStateObserver registers an observer that is notified about every pump state change
+func (obj *OverrideService) AddStateObserver(observer PumpStateObserver) {
+	obj.pumpsSvc.AddStateObserver(observer)
+}
+
+// Close stops the override timers, pumps are left in their current state, the wrapped PumpsService is not closed
+func (obj *OverrideService) Close() error {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.closed = true
+	for pumpID, o := range obj.overrides {
+		o.timer.Stop()
+		delete(obj.overrides, pumpID)
+	}
+	return nil
+}
+
+// expire ends the override once its time elapsed
+func (obj *OverrideService) expire(pumpID PumpID, o *activeOverride) {
+	log.Info().Msgf("Pump %d override elapsed", pumpID)
+	err := obj.end(pumpID, o)
+	if err != nil {
+		log.Error().Msgf("failed to end pump %d override: %s", pumpID, err)
+	}
+}
+
+// end removes the override, unless it was replaced meanwhile, and sets the last requested state
+func (obj *OverrideService) end(pumpID PumpID, o *activeOverride) error {
+	obj.mu.Lock()
+	if obj.closed || obj.overrides[pumpID] != o {
+		obj.mu.Unlock()
+		return nil
+	}
+	delete(obj.overrides, pumpID)
+	state := obj.requested[pumpID]
+	observers := obj.observers
+	obj.mu.Unlock()
+
+	for _, observer := range observers {
+		observer(pumpID, nil)
+	}
+
+	log.Info().Msgf("Pump %d override ended, returning to %s", pumpID, stateName(state))
+	err := obj.pumpsSvc.SetPumpState(pumpID, state)
+	var delayedErr *SwitchDelayedError
+	// safety rules remember the state and apply it once they are released
+	if errors.As(err, &delayedErr) || errors.Is(err, ErrPumpInterlocked) {
+		return nil
+	}
+	return err
+}
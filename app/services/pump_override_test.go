@@ -0,0 +1,106 @@
+package services
+
+import (
+	"errors"
+	"rpi-heating-system/app/config"
+	"testing"
+	"time"
+)
+
+// overrideConfig returns two pumps with the default override duration
+func overrideConfig() *config.AppConfig {
+	return &config.AppConfig{Pumps: []*config.PumpConfig{{ID: 1}, {ID: 2}}}
+}
+
+func TestOverrideRefusesCommandsWhileSwitching(t *testing.T) {
+	pumps := newFakePumps()
+	pumps.entered = make(chan struct{}, 1)
+	pumps.release = make(chan struct{})
+	ov := NewOverrideService(pumps, overrideConfig())
+	defer ov.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- ov.Override(1, PumpON, time.Hour)
+	}()
+	// the override switch is on its way to the pump
+	<-pumps.entered
+
+	err := ov.SetPumpState(1, PumpOFF)
+	if !errors.Is(err, ErrPumpOverridden) {
+		t.Errorf("command during the override switch error = %v, want ErrPumpOverridden", err)
+	}
+	close(pumps.release)
+	if err := <-done; err != nil {
+		t.Fatalf("Override: %s", err)
+	}
+	if pumps.state(1) != PumpON {
+		t.Errorf("pump state = %d, want the override state", pumps.state(1))
+	}
+
+	// the refused command is applied once the override ends
+	err = ov.Cancel(1)
+	if err != nil {
+		t.Fatalf("Cancel: %s", err)
+	}
+	if pumps.state(1) != PumpOFF {
+		t.Error("refused command not applied after the override")
+	}
+}
+
+func TestOverrideRollback(t *testing.T) {
+	pumps := newFakePumps()
+	ov := NewOverrideService(pumps, overrideConfig())
+	defer ov.Close()
+
+	// a failed first override leaves no override behind
+	pumps.err = ErrSwitchRejected
+	err := ov.Override(1, PumpON, time.Hour)
+	if !errors.Is(err, ErrSwitchRejected) {
+		t.Fatalf("Override error = %v, want ErrSwitchRejected", err)
+	}
+	if _, ok := ov.ActiveOverride(1); ok {
+		t.Error("failed override is still active")
+	}
+
+	// a failed replacement reinstates the previous override
+	pumps.err = nil
+	err = ov.Override(1, PumpON, time.Hour)
+	if err != nil {
+		t.Fatalf("Override: %s", err)
+	}
+	pumps.err = ErrSwitchRejected
+	err = ov.Override(1, PumpOFF, 10*time.Minute)
+	if !errors.Is(err, ErrSwitchRejected) {
+		t.Fatalf("replacing Override error = %v, want ErrSwitchRejected", err)
+	}
+	override, ok := ov.ActiveOverride(1)
+	if !ok || override.State != PumpON || time.Until(override.Until) < 50*time.Minute {
+		t.Errorf("override = %+v, %t, want the previous ON override", override, ok)
+	}
+
+	// the reinstated override still ends
+	pumps.err = nil
+	err = ov.Cancel(1)
+	if err != nil {
+		t.Fatalf("Cancel: %s", err)
+	}
+	if _, ok := ov.ActiveOverride(1); ok {
+		t.Error("reinstated override was not cancelled")
+	}
+}
+
+func TestOverrideDelayedSwitchKeepsOverride(t *testing.T) {
+	pumps := newFakePumps()
+	pumps.err = &SwitchDelayedError{PumpID: 1, State: PumpON, Until: time.Now().Add(time.Minute)}
+	ov := NewOverrideService(pumps, overrideConfig())
+	defer ov.Close()
+
+	err := ov.Override(1, PumpON, time.Hour)
+	if err != nil {
+		t.Fatalf("Override error = %v, a delayed switch is not a failure", err)
+	}
+	if _, ok := ov.ActiveOverride(1); !ok {
+		t.Error("override with a delayed switch is not active")
+	}
+}
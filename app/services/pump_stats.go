@@ -0,0 +1,75 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// PumpStats holds the runtime accounting of a single pump
+type PumpStats struct {
+	RuntimeSeconds float64   `json:"runtime_seconds"` // cumulative time the pump was ON
+	Starts         int       `json:"starts"`          // number of OFF to ON switches
+	EnergyKWh      float64   `json:"energy_kwh"`      // consumed energy based on the rated wattage of the pump
+	LastOn         time.Time `json:"last_on"`         // last time the pump was switched ON
+	LastOff        time.Time `json:"last_off"`        // last time the pump was switched OFF
+}
+
+// loadPumpStats reads the pump statistics from the JSON file on the given path
+// A missing file is not an error, the accounting simply starts from zero
+func loadPumpStats(path string) (map[PumpID]*PumpStats, error) {
+	stats := make(map[PumpID]*PumpStats)
+	data, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pump stats file: %w", err)
+	}
+	defer data.Close()
+
+	byteResult, err := io.ReadAll(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pump stats file: %w", err)
+	}
+	err = jsoniter.Unmarshal(byteResult, &stats)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pump stats: %w", err)
+	}
+	return stats, nil
+}
+
+// savePumpStats writes the pump statistics to the JSON file on the given path
+// The file is replaced atomically so a power loss never leaves a truncated file behind
+func savePumpStats(path string, stats map[PumpID]*PumpStats) error {
+	byteResult, err := jsoniter.MarshalIndent(stats, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal pump stats: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create pump stats file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(byteResult)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write pump stats file: %w", err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to replace pump stats file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,482 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"rpi-heating-system/app/config"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrPumpInterlocked is returned when a pump command conflicts with an active safety rule
+var ErrPumpInterlocked = errors.New("pump is forced ON by a safety rule")
+
+// SafetyRuleKind represents the kind of condition a safety rule protects against
+type SafetyRuleKind string
+
+const (
+	SafetyRuleOverheat SafetyRuleKind = "overheat" // SafetyRuleOverheat forces pumps ON above a temperature limit.
+	SafetyRuleFrost    SafetyRuleKind = "frost"    // SafetyRuleFrost forces pumps ON below a temperature limit.
+)
+
+// SafetyRuleObserver is called after a safety rule has been activated, released or its sensors failed
+type SafetyRuleObserver func(rule SafetyRuleInfo)
+
+// SafetyRuleInfo describes a safety rule and its current state
+type SafetyRuleInfo struct {
+	Key          string // unique key of the rule, e.g. "overheat_1"
+	Kind         SafetyRuleKind
+	Name         string
+	Active       bool
+	Fault        bool     // a linked sensor failed or stopped reporting, the rule is held active
+	FaultSensors []string // sensors without a current reading
+}
+
+// safetyCheckInterval is the interval at which the rules are checked for sensors that stopped reporting
+const safetyCheckInterval = 10 * time.Second
+
+// sensorReading is the latest reading of a sensor linked to a safety rule
+type sensorReading struct {
+	temp   float64
+	time   time.Time     // time of the reading, or of the rule start before the first reading
+	valid  bool          // temp holds a reading
+	failed bool          // the latest read of the sensor failed
+	maxAge time.Duration // readings older than this are expired
+}
+
+// missing returns true if the sensor failed or has not reported within its maximum age
+func (rd *sensorReading) missing(now time.Time) bool {
+	return rd.failed || now.Sub(rd.time) > rd.maxAge
+}
+
+// safetyRule forces pumps ON while any of the linked sensors is beyond the limit
+// A rule fails safe, it is held active while any of its sensors is missing
+type safetyRule struct {
+	key          string
+	kind         SafetyRuleKind
+	name         string
+	sensorIDs    []string
+	readings     map[string]*sensorReading // keyed by sensor ID
+	pumps        []PumpID
+	limit        float64
+	hysteresis   float64
+	active       bool
+	applied      bool // active state the pumps were last switched to
+	faultSensors []string
+}
+
+// hasSensor returns true if the sensor is linked to the rule
+func (r *safetyRule) hasSensor(sensorID string) bool {
+	_, ok := r.readings[sensorID]
+	return ok
+}
+
+// update records a new sensor reading and returns true if the rule state changed
+func (r *safetyRule) update(sensorID string, temp float64, now time.Time) bool {
+	rd := r.readings[sensorID]
+	rd.temp = temp
+	rd.time = now
+	rd.valid = true
+	rd.failed = false
+	return r.evaluate(now)
+}
+
+// fail records a failed read of the sensor and returns true if the rule state changed
+func (r *safetyRule) fail(sensorID string, now time.Time) bool {
+	r.readings[sensorID].failed = true
+	return r.evaluate(now)
+}
+
+// evaluate evaluates the rule with the current readings and returns true if the rule state changed
+// An overheat rule activates when the hottest sensor is above the limit and releases below limit-hysteresis,
+// a frost rule activates when the coldest sensor is below the limit and releases above limit+hysteresis
+func (r *safetyRule) evaluate(now time.Time) bool {
+	var temps []float64
+	var missing []string
+	for _, id := range r.sensorIDs {
+		rd := r.readings[id]
+		if rd.missing(now) {
+			missing = append(missing, id)
+		} else if rd.valid {
+			temps = append(temps, rd.temp)
+		}
+	}
+
+	active := r.active
+	switch {
+	case len(missing) > 0:
+		active = true
+	case len(temps) == 0:
+		// no sensor reported yet, nothing to decide on
+	case r.kind == SafetyRuleOverheat:
+		hottest := temps[0]
+		for _, t := range temps {
+			if t > hottest {
+				hottest = t
+			}
+		}
+		if hottest > r.limit {
+			active = true
+		} else if hottest < r.limit-r.hysteresis {
+			active = false
+		}
+	case r.kind == SafetyRuleFrost:
+		coldest := temps[0]
+		for _, t := range temps {
+			if t < coldest {
+				coldest = t
+			}
+		}
+		if coldest < r.limit {
+			active = true
+		} else if coldest > r.limit+r.hysteresis {
+			active = false
+		}
+	}
+	changed := active != r.active || strings.Join(missing, ",") != strings.Join(r.faultSensors, ",")
+	r.active = active
+	r.faultSensors = missing
+	return changed
+}
+
+// info returns the description and current state of the rule
+func (r *safetyRule) info() SafetyRuleInfo {
+	return SafetyRuleInfo{
+		Key:          r.key,
+		Kind:         r.kind,
+		Name:         r.name,
+		Active:       r.active,
+		Fault:        len(r.faultSensors) > 0,
+		FaultSensors: append([]string(nil), r.faultSensors...),
+	}
+}
+
+// SafetyRulesService is a PumpsService layer that enforces safety rules on top of another PumpsService
+// While a rule is active its pumps are forced ON and OFF commands are refused with ErrPumpInterlocked.
+// Requested states are remembered and restored once all rules of a pump are released.
+// Sensor readings expire after a few poll intervals, a rule with a failed or silent sensor is held active.
+type SafetyRulesService struct {
+	pumpsSvc PumpsService
+	// switchMu serializes the interlock check with the switch of the wrapped service,
+	// so a rule activated in between cannot be undone by a stale OFF, it is taken before mu
+	switchMu  sync.Mutex
+	mu        sync.Mutex
+	rules     []*safetyRule
+	requested map[PumpID]PumpState // last state requested through this layer
+	observers []SafetyRuleObserver
+	done      chan struct{}
+}
+
+// NewSafetyRulesService creates a new SafetyRulesService wrapping the given PumpsService
+func NewSafetyRulesService(pumpsSvc PumpsService, conf *config.AppConfig) (*SafetyRulesService, error) {
+
+	sr := &SafetyRulesService{
+		pumpsSvc:  pumpsSvc,
+		requested: make(map[PumpID]PumpState),
+		done:      make(chan struct{}),
+	}
+
+	// a reading is as old as the sampler cache allows
+	maxAges := make(map[string]time.Duration)
+	for _, sensor := range conf.TempSensors {
+		maxAges[sensor.ID] = staleSampleIntervals * sensorPollInterval(conf, sensor)
+	}
+	pumps := make(map[int]bool)
+	for _, pump := range conf.Pumps {
+		pumps[pump.ID] = true
+	}
+
+	for _, interlock := range conf.Interlocks {
+		rule := &safetyRule{
+			key:        fmt.Sprintf("%s_%d", SafetyRuleOverheat, interlock.ID),
+			kind:       SafetyRuleOverheat,
+			name:       interlock.Name,
+			sensorIDs:  []string{interlock.SensorID},
+			limit:      interlock.MaxTemp,
+			hysteresis: interlock.Hysteresis,
+		}
+		err := sr.addRule(rule, interlock.PumpIDs, maxAges, pumps)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, frost := range conf.Frost {
+		rule := &safetyRule{
+			key:        fmt.Sprintf("%s_%d", SafetyRuleFrost, frost.ID),
+			kind:       SafetyRuleFrost,
+			name:       frost.Name,
+			sensorIDs:  frost.SensorIDs,
+			limit:      frost.FrostTemp,
+			hysteresis: frost.Hysteresis,
+		}
+		err := sr.addRule(rule, frost.PumpIDs, maxAges, pumps)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go sr.watch()
+	return sr, nil
+}
+
+// addRule validates the rule sensors and pumps against the configuration and adds the rule
+func (obj *SafetyRulesService) addRule(rule *safetyRule, pumpIDs []int, maxAges map[string]time.Duration, pumps map[int]bool) error {
+	if len(rule.sensorIDs) == 0 {
+		return fmt.Errorf("safety rule %s has no sensors", rule.name)
+	}
+	now := time.Now()
+	rule.readings = make(map[string]*sensorReading)
+	for _, id := range rule.sensorIDs {
+		maxAge, ok := maxAges[id]
+		if !ok {
+			return fmt.Errorf("safety rule %s sensor %s does not exist", rule.name, id)
+		}
+		// the first reading is expected within maxAge of the start
+		rule.readings[id] = &sensorReading{time: now, maxAge: maxAge}
+	}
+	for _, id := range pumpIDs {
+		if !pumps[id] {
+			return fmt.Errorf("safety rule %s pump %d does not exist", rule.name, id)
+		}
+		rule.pumps = append(rule.pumps, PumpID(id))
+	}
+	obj.rules = append(obj.rules, rule)
+	return nil
+}
+
+// Rules returns the description and current state of all safety rules
+func (obj *SafetyRulesService) Rules() []SafetyRuleInfo {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	rules := make([]SafetyRuleInfo, 0, len(obj.rules))
+	for _, rule := range obj.rules {
+		rules = append(rules, rule.info())
+	}
+	return rules
+}
+
+// AddRuleObserver registers an observer that is notified when a safety rule is activated, released or faulted
+func (obj *SafetyRulesService) AddRuleObserver(observer SafetyRuleObserver) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.observers = append(obj.observers, observer)
+}
+
+// OnTemperature evaluates the safety rules linked to the sensor with a new reading
+func (obj *SafetyRulesService) OnTemperature(sensorID string, temp float64) {
+	now := time.Now()
+	obj.mu.Lock()
+	var changed []*safetyRule
+	for _, rule := range obj.rules {
+		if rule.hasSensor(sensorID) && rule.update(sensorID, temp, now) {
+			changed = append(changed, rule)
+		}
+	}
+	obj.mu.Unlock()
+
+	for _, rule := range changed {
+		obj.applyRule(rule, fmt.Sprintf("sensor %s at %.2f", sensorID, temp))
+	}
+}
+
+// OnSample marks the sensor as missing in the linked safety rules when its read failed
+// Successful readings arrive through OnTemperature
+func (obj *SafetyRulesService) OnSample(sensorID string, sample TempSample) {
+	if sample.Err == nil {
+		return
+	}
+	now := time.Now()
+	obj.mu.Lock()
+	var changed []*safetyRule
+	for _, rule := range obj.rules {
+		if rule.hasSensor(sensorID) && rule.fail(sensorID, now) {
+			changed = append(changed, rule)
+		}
+	}
+	obj.mu.Unlock()
+
+	for _, rule := range changed {
+		obj.applyRule(rule, fmt.Sprintf("sensor %s failed: %s", sensorID, sample.Err))
+	}
+}
+
+// SetPumpState sets the pump state unless an active safety rule forces the pump ON
+func (obj *SafetyRulesService) SetPumpState(pumpID PumpID, state PumpState) error {
+	obj.switchMu.Lock()
+	defer obj.switchMu.Unlock()
+
+	obj.mu.Lock()
+	obj.requested[pumpID] = state
+	forced := obj.isForced(pumpID)
+	obj.mu.Unlock()
+
+	if forced && state == PumpOFF {
+		log.Warn().Msgf("Pump %d OFF command ignored, safety rule is active", pumpID)
+		return fmt.Errorf("pump %d: %w", pumpID, ErrPumpInterlocked)
+	}
+	return obj.pumpsSvc.SetPumpState(pumpID, state)
+}
+
+// ForcePumpState sets the pump state immediately, bypassing the anti-short-cycling limits
+// The interlock still applies, a pump forced ON by an active rule can not be forced OFF
+func (obj *SafetyRulesService) ForcePumpState(pumpID PumpID, state PumpState) error {
+	obj.switchMu.Lock()
+	defer obj.switchMu.Unlock()
+
+	obj.mu.Lock()
+	obj.requested[pumpID] = state
+	forced := obj.isForced(pumpID)
+	obj.mu.Unlock()
+
+	if forced && state == PumpOFF {
+		log.Warn().Msgf("Pump %d forced OFF command ignored, safety rule is active", pumpID)
+		return fmt.Errorf("pump %d: %w", pumpID, ErrPumpInterlocked)
+	}
+	return obj.pumpsSvc.ForcePumpState(pumpID, state)
+}
+
+// GetPumpState returns the current state of the pump
+func (obj *SafetyRulesService) GetPumpState(pumpID PumpID) (PumpState, error) {
+	return obj.pumpsSvc.GetPumpState(pumpID)
+}
+
+// GetPumpStats returns the runtime accounting of the pump
+func (obj *SafetyRulesService) GetPumpStats(pumpID PumpID) (PumpStats, error) {
+	return obj.pumpsSvc.GetPumpStats(pumpID)
+}
+
+// AddStateObserver registers an observer that is notified about every pump state change
+func (obj *SafetyRulesService) AddStateObserver(observer PumpStateObserver) {
+	obj.pumpsSvc.AddStateObserver(observer)
+}
+
+// Close stops the expiry checks, the wrapped PumpsService is not closed
+func (obj *SafetyRulesService) Close() error {
+	close(obj.done)
+	return nil
+}
+
+// watch periodically expires the readings of sensors that stopped reporting
+// A stuck read is skipped by the sampler without any result, so failures alone do not cover it
+func (obj *SafetyRulesService) watch() {
+	ticker := time.NewTicker(safetyCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-obj.done:
+			return
+		case now := <-ticker.C:
+			obj.expire(now)
+		}
+	}
+}
+
+// expire evaluates all rules at the given time and applies those whose readings expired
+func (obj *SafetyRulesService) expire(now time.Time) {
+	obj.mu.Lock()
+	var changed []*safetyRule
+	for _, rule := range obj.rules {
+		if rule.evaluate(now) {
+			changed = append(changed, rule)
+		}
+	}
+	obj.mu.Unlock()
+
+	for _, rule := range changed {
+		obj.applyRule(rule, "sensor readings expired")
+	}
+}
+
+// applyRule forces the rule pumps ON or restores their requested states and notifies observers
+func (obj *SafetyRulesService) applyRule(rule *safetyRule, reason string) {
+	obj.mu.Lock()
+	info := rule.info()
+	switchPumps := info.Active != rule.applied
+	rule.applied = info.Active
+	observers := obj.observers
+	obj.mu.Unlock()
+
+	switch {
+	case info.Fault:
+		log.Error().Msgf("Safety rule %s sensors %s not reporting, %s, forcing pumps ON",
+			rule.name, strings.Join(info.FaultSensors, ", "), reason)
+	case !switchPumps:
+		log.Info().Msgf("Safety rule %s sensors reporting again, %s, rule stays active", rule.name, reason)
+	case info.Active:
+		log.Warn().Msgf("Safety rule %s activated, %s, forcing pumps ON", rule.name, reason)
+	default:
+		log.Info().Msgf("Safety rule %s released, %s", rule.name, reason)
+	}
+
+	if switchPumps {
+		for _, pumpID := range rule.pumps {
+			var err error
+			if info.Active {
+				err = obj.forcePump(pumpID)
+			} else {
+				err = obj.restorePump(pumpID)
+			}
+			if err != nil {
+				log.Error().Msgf("safety rule %s failed to switch pump %d: %s", rule.name, pumpID, err)
+			}
+		}
+	}
+
+	for _, observer := range observers {
+		observer(info)
+	}
+}
+
+// forcePump switches the pump ON, remembering its current state if nothing was requested yet
+func (obj *SafetyRulesService) forcePump(pumpID PumpID) error {
+	obj.switchMu.Lock()
+	defer obj.switchMu.Unlock()
+
+	obj.mu.Lock()
+	_, ok := obj.requested[pumpID]
+	obj.mu.Unlock()
+	if !ok {
+		state, err := obj.pumpsSvc.GetPumpState(pumpID)
+		if err != nil {
+			return err
+		}
+		obj.mu.Lock()
+		obj.requested[pumpID] = state
+		obj.mu.Unlock()
+	}
+	return obj.pumpsSvc.ForcePumpState(pumpID, PumpON)
+}
+
+// restorePump sets the last requested state once no other active rule forces the pump
+func (obj *SafetyRulesService) restorePump(pumpID PumpID) error {
+	obj.switchMu.Lock()
+	defer obj.switchMu.Unlock()
+
+	obj.mu.Lock()
+	state, ok := obj.requested[pumpID]
+	forced := obj.isForced(pumpID)
+	obj.mu.Unlock()
+	if forced || !ok {
+		return nil
+	}
+	return obj.pumpsSvc.SetPumpState(pumpID, state)
+}
+
+// isForced returns true if any active rule forces the pump ON, the lock must be held
+func (obj *SafetyRulesService) isForced(pumpID PumpID) bool {
+	for _, rule := range obj.rules {
+		if !rule.active {
+			continue
+		}
+		for _, id := range rule.pumps {
+			if id == pumpID {
+				return true
+			}
+		}
+	}
+	return false
+}
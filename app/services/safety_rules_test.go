@@ -0,0 +1,294 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"rpi-heating-system/app/config"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePumps is a PumpsService switching pumps immediately and recording every call
+type fakePumps struct {
+	mu      sync.Mutex
+	states  map[PumpID]PumpState
+	calls   []string
+	entered chan struct{} // receives when SetPumpState is entered, if set
+	release chan struct{} // SetPumpState waits for it before switching, if set
+	err     error         // returned by SetPumpState without switching, if set
+}
+
+func newFakePumps() *fakePumps {
+	return &fakePumps{states: make(map[PumpID]PumpState)}
+}
+
+func (obj *fakePumps) SetPumpState(pumpID PumpID, state PumpState) error {
+	if obj.entered != nil {
+		obj.entered <- struct{}{}
+	}
+	if obj.release != nil {
+		<-obj.release
+	}
+	if obj.err != nil {
+		return obj.err
+	}
+	return obj.record("set", pumpID, state)
+}
+
+func (obj *fakePumps) ForcePumpState(pumpID PumpID, state PumpState) error {
+	return obj.record("force", pumpID, state)
+}
+
+func (obj *fakePumps) record(call string, pumpID PumpID, state PumpState) error {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.states[pumpID] = state
+	obj.calls = append(obj.calls, fmt.Sprintf("%s %d %s", call, pumpID, stateName(state)))
+	return nil
+}
+
+func (obj *fakePumps) GetPumpState(pumpID PumpID) (PumpState, error) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	return obj.states[pumpID], nil
+}
+
+func (obj *fakePumps) state(pumpID PumpID) PumpState {
+	state, _ := obj.GetPumpState(pumpID)
+	return state
+}
+
+func (obj *fakePumps) AddStateObserver(observer PumpStateObserver) {}
+
+func (obj *fakePumps) GetPumpStats(pumpID PumpID) (PumpStats, error) {
+	return PumpStats{}, nil
+}
+
+func (obj *fakePumps) Close() error {
+	return nil
+}
+
+// safetyConfig returns an overheat interlock on sensor "boiler" above 90 °C with 5 °C hysteresis for pump 1
+func safetyConfig() *config.AppConfig {
+	return &config.AppConfig{
+		TempSensors: []*config.TempSensorsConfig{{ID: "boiler"}},
+		Pumps:       []*config.PumpConfig{{ID: 1}, {ID: 2}},
+		Interlocks: []*config.InterlockConfig{
+			{ID: 1, Name: "Boiler overheat", SensorID: "boiler", MaxTemp: 90, Hysteresis: 5, PumpIDs: []int{1}},
+		},
+	}
+}
+
+func TestSafetyRulesInterlock(t *testing.T) {
+	pumps := newFakePumps()
+	sr, err := NewSafetyRulesService(pumps, safetyConfig())
+	if err != nil {
+		t.Fatalf("NewSafetyRulesService: %s", err)
+	}
+	defer sr.Close()
+	var infos []SafetyRuleInfo
+	sr.AddRuleObserver(func(rule SafetyRuleInfo) {
+		infos = append(infos, rule)
+	})
+
+	steps := []struct {
+		name   string
+		temp   float64
+		state  PumpState
+		active bool
+	}{
+		{"below limit", 85, PumpOFF, false},
+		{"at limit", 90, PumpOFF, false},
+		{"above limit", 90.5, PumpON, true},
+		{"within hysteresis", 86, PumpON, true},
+		{"below limit minus hysteresis", 84.5, PumpOFF, false},
+		{"above limit again", 95, PumpON, true},
+	}
+	for _, step := range steps {
+		sr.OnTemperature("boiler", step.temp)
+		if got := pumps.state(1); got != step.state {
+			t.Errorf("%s: pump state = %d, want %d", step.name, got, step.state)
+		}
+		if got := sr.Rules()[0].Active; got != step.active {
+			t.Errorf("%s: rule active = %t, want %t", step.name, got, step.active)
+		}
+	}
+	if len(infos) != 3 {
+		t.Errorf("rule observers notified %d times, want 3", len(infos))
+	}
+	if pumps.state(2) != PumpOFF {
+		t.Error("pump without rule was switched")
+	}
+}
+
+func TestSafetyRulesRefuseOff(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		t.Run(fmt.Sprintf("force %t", force), func(t *testing.T) {
+			pumps := newFakePumps()
+			sr, err := NewSafetyRulesService(pumps, safetyConfig())
+			if err != nil {
+				t.Fatalf("NewSafetyRulesService: %s", err)
+			}
+			defer sr.Close()
+			sr.OnTemperature("boiler", 95)
+
+			set := sr.SetPumpState
+			if force {
+				set = sr.ForcePumpState
+			}
+			err = set(1, PumpOFF)
+			if !errors.Is(err, ErrPumpInterlocked) {
+				t.Errorf("OFF error = %v, want ErrPumpInterlocked", err)
+			}
+			if pumps.state(1) != PumpON {
+				t.Error("interlocked pump was switched OFF")
+			}
+			err = set(1, PumpON)
+			if err != nil {
+				t.Errorf("ON error = %v", err)
+			}
+			err = set(2, PumpOFF)
+			if err != nil {
+				t.Errorf("OFF of a pump without active rule failed: %s", err)
+			}
+		})
+	}
+}
+
+func TestSafetyRulesRestoreRequested(t *testing.T) {
+	tests := []struct {
+		name   string
+		before []PumpState // states requested before the rule activates
+		during []PumpState // states requested while the rule is active
+		want   PumpState
+	}{
+		{"nothing requested keeps the state before the rule", nil, nil, PumpOFF},
+		{"ON requested before", []PumpState{PumpON}, nil, PumpON},
+		{"OFF refused while active", []PumpState{PumpON}, []PumpState{PumpOFF}, PumpOFF},
+		{"ON requested while active", nil, []PumpState{PumpON}, PumpON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pumps := newFakePumps()
+			sr, err := NewSafetyRulesService(pumps, safetyConfig())
+			if err != nil {
+				t.Fatalf("NewSafetyRulesService: %s", err)
+			}
+			defer sr.Close()
+			for _, state := range tt.before {
+				_ = sr.SetPumpState(1, state)
+			}
+			sr.OnTemperature("boiler", 95)
+			for _, state := range tt.during {
+				_ = sr.SetPumpState(1, state)
+			}
+			sr.OnTemperature("boiler", 80)
+			if got := pumps.state(1); got != tt.want {
+				t.Errorf("restored state = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSafetyRulesOffRacesActivation(t *testing.T) {
+	pumps := newFakePumps()
+	pumps.entered = make(chan struct{}, 1)
+	pumps.release = make(chan struct{})
+	sr, err := NewSafetyRulesService(pumps, safetyConfig())
+	if err != nil {
+		t.Fatalf("NewSafetyRulesService: %s", err)
+	}
+	defer sr.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = sr.SetPumpState(1, PumpOFF)
+	}()
+	// the OFF passed the interlock check and is on its way to the pump
+	<-pumps.entered
+	go func() {
+		defer wg.Done()
+		sr.OnTemperature("boiler", 95)
+	}()
+	// give the rule the chance to force the pump before the OFF lands
+	time.Sleep(50 * time.Millisecond)
+	close(pumps.release)
+	wg.Wait()
+
+	if pumps.state(1) != PumpON {
+		t.Errorf("pump is OFF while the interlock is active, calls: %v", pumps.calls)
+	}
+}
+
+func TestSafetyRulesSensorFault(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault func(sr *SafetyRulesService)
+	}{
+		{"read failed", func(sr *SafetyRulesService) {
+			sr.OnSample("boiler", TempSample{Err: ErrReadTimeout})
+		}},
+		{"reading expired", func(sr *SafetyRulesService) {
+			sr.expire(time.Now().Add(2 * time.Minute))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pumps := newFakePumps()
+			sr, err := NewSafetyRulesService(pumps, safetyConfig())
+			if err != nil {
+				t.Fatalf("NewSafetyRulesService: %s", err)
+			}
+			defer sr.Close()
+
+			sr.OnTemperature("boiler", 60)
+			if sr.Rules()[0].Active {
+				t.Fatal("rule active at normal temperature")
+			}
+
+			tt.fault(sr)
+			rule := sr.Rules()[0]
+			if !rule.Active || !rule.Fault || len(rule.FaultSensors) != 1 || rule.FaultSensors[0] != "boiler" {
+				t.Errorf("rule = %+v, want active with fault of sensor boiler", rule)
+			}
+			if pumps.state(1) != PumpON {
+				t.Error("pump not forced ON with a missing interlock sensor")
+			}
+			if !errors.Is(sr.SetPumpState(1, PumpOFF), ErrPumpInterlocked) {
+				t.Error("OFF accepted with a missing interlock sensor")
+			}
+
+			// the sensor is back at normal temperature
+			sr.OnTemperature("boiler", 60)
+			rule = sr.Rules()[0]
+			if rule.Active || rule.Fault {
+				t.Errorf("rule = %+v, want released without fault", rule)
+			}
+			if pumps.state(1) != PumpOFF {
+				t.Error("requested OFF not restored")
+			}
+		})
+	}
+}
+
+func TestSafetyRulesSensorNeverReported(t *testing.T) {
+	pumps := newFakePumps()
+	sr, err := NewSafetyRulesService(pumps, safetyConfig())
+	if err != nil {
+		t.Fatalf("NewSafetyRulesService: %s", err)
+	}
+	defer sr.Close()
+
+	// the first reading is not due yet
+	sr.expire(time.Now().Add(time.Minute))
+	if sr.Rules()[0].Active {
+		t.Fatal("rule active before the first reading was due")
+	}
+	sr.expire(time.Now().Add(2 * time.Minute))
+	if rule := sr.Rules()[0]; !rule.Active || !rule.Fault {
+		t.Errorf("rule = %+v, want active with fault", rule)
+	}
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"rpi-heating-system/app/config"
+	"sort"
+	"sync"
+)
+
+// TempDriver reads a single temperature sensor
+type TempDriver interface {
+	Read() (float64, error)
+	io.Closer
+}
+
+// HumidityDriver is implemented by drivers of sensors that also measure relative humidity
+type HumidityDriver interface {
+	ReadHumidity() (float64, error)
+}
+
+// TempDriverFactory creates the driver of a single sensor from its config
+type TempDriverFactory func(sensor *config.TempSensorsConfig) (TempDriver, error)
+
+var (
+	tempDriversMu sync.Mutex
+	tempDrivers   = map[string]TempDriverFactory{
+		config.SensorTypeMAX31865:   newMAX31865Driver,
+		config.SensorTypeThermistor: newThermistorDriver,
+		config.SensorTypeBME280:     newBME280Driver,
+	}
+)
+
+// RegisterTempDriver makes a driver available for sensors with the type in the config
+func RegisterTempDriver(sensorType string, factory TempDriverFactory) {
+	tempDriversMu.Lock()
+	defer tempDriversMu.Unlock()
+	tempDrivers[sensorType] = factory
+}
+
+// TempSensorRegistry routes reads of each configured sensor to the driver of its type
+// DS18B20 sensors are read by the shared DS18B20Service, every other sensor has its own driver
+type TempSensorRegistry struct {
+	ds18b20 *DS18B20Service
+	drivers map[string]TempDriver // keyed by sensor ID
+	ranges  map[string]sensorRange
+}
+
+// NewTempSensorRegistry creates the drivers of all configured sensors
+func NewTempSensorRegistry(conf *config.AppConfig, ds18b20 *DS18B20Service) (*TempSensorRegistry, error) {
+	r := &TempSensorRegistry{
+		ds18b20: ds18b20,
+		drivers: make(map[string]TempDriver),
+		ranges:  make(map[string]sensorRange),
+	}
+	for _, sensor := range conf.TempSensors {
+		sensorType := sensor.DriverType()
+		if sensorType == config.SensorTypeDS18B20 {
+			continue
+		}
+		tempDriversMu.Lock()
+		factory, ok := tempDrivers[sensorType]
+		tempDriversMu.Unlock()
+		if !ok {
+			r.Close()
+			return nil, fmt.Errorf("sensor %s has unknown type %q", sensor.ID, sensorType)
+		}
+		if sensor.Device == "" {
+			r.Close()
+			return nil, fmt.Errorf("sensor %s of type %s has no device", sensor.ID, sensorType)
+		}
+		driver, err := factory(sensor)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("failed to create %s driver for sensor %s: %w", sensorType, sensor.ID, err)
+		}
+		r.drivers[sensor.ID] = driver
+
+		// DS18B20Service validates its own range, other drivers are checked against the config only
+		if sensor.MinTemp != nil || sensor.MaxTemp != nil {
+			sr := sensorRange{min: -273.15, max: 10000}
+			if sensor.MinTemp != nil {
+				sr.min = *sensor.MinTemp
+			}
+			if sensor.MaxTemp != nil {
+				sr.max = *sensor.MaxTemp
+			}
+			r.ranges[sensor.ID] = sr
+		}
+	}
+	return r, nil
+}
+
+// Read returns the temperature of the sensor in °C
+func (obj *TempSensorRegistry) Read(id string) (float64, error) {
+	driver, ok := obj.drivers[id]
+	if !ok {
+		return obj.ds18b20.Read(id)
+	}
+	temp, err := driver.Read()
+	if err != nil {
+		return 0.0, fmt.Errorf("failed to read sensor %s: %w", id, err)
+	}
+	sr, ok := obj.ranges[id]
+	if ok && (temp < sr.min || temp > sr.max) {
+		return 0.0, fmt.Errorf("sensor %s value %.3f outside of %.1f..%.1f err: %w", id, temp, sr.min, sr.max, ErrOutOfRange)
+	}
+	return temp, nil
+}
+
+// HumiditySensors returns the IDs of all sensors that measure relative humidity
+func (obj *TempSensorRegistry) HumiditySensors() []string {
+	var ids []string
+	for id, driver := range obj.drivers {
+		if _, ok := driver.(HumidityDriver); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ReadHumidity returns the relative humidity of the sensor in %
+func (obj *TempSensorRegistry) ReadHumidity(id string) (float64, error) {
+	driver, ok := obj.drivers[id].(HumidityDriver)
+	if !ok {
+		return 0.0, fmt.Errorf("sensor %s does not measure humidity", id)
+	}
+	humidity, err := driver.ReadHumidity()
+	if err != nil {
+		return 0.0, fmt.Errorf("failed to read sensor %s humidity: %w", id, err)
+	}
+	return humidity, nil
+}
+
+// Close closes all drivers
+func (obj *TempSensorRegistry) Close() error {
+	var firstErr error
+	for id, driver := range obj.drivers {
+		err := driver.Close()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to close sensor %s driver: %w", id, err)
+		}
+	}
+	return firstErr
+}
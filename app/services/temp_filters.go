@@ -0,0 +1,120 @@
+package services
+
+import (
+	"fmt"
+	"rpi-heating-system/app/config"
+	"sort"
+	"time"
+)
+
+const (
+	// FilterMedian replaces a reading with the median of the last Window readings
+	FilterMedian = "median"
+	// FilterEMA smooths readings with an exponential moving average
+	FilterEMA = "ema"
+	// FilterRateLimit clamps the change between readings to MaxRate °C per minute
+	FilterRateLimit = "rate_limit"
+)
+
+// TempFilter transforms a stream of readings of a single sensor
+type TempFilter interface {
+	Apply(temp float64, at time.Time) float64
+}
+
+// newTempFilters creates the filter pipeline of a sensor in the configured order
+func newTempFilters(cfgs []*config.FilterConfig) ([]TempFilter, error) {
+	filters := make([]TempFilter, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		switch cfg.Type {
+		case FilterMedian:
+			if cfg.Window < 2 {
+				return nil, fmt.Errorf("median filter window must be at least 2, got %d", cfg.Window)
+			}
+			filters = append(filters, &medianFilter{window: cfg.Window})
+		case FilterEMA:
+			if cfg.Alpha <= 0 || cfg.Alpha > 1 {
+				return nil, fmt.Errorf("ema filter alpha must be in (0, 1], got %.3f", cfg.Alpha)
+			}
+			filters = append(filters, &emaFilter{alpha: cfg.Alpha})
+		case FilterRateLimit:
+			if cfg.MaxRate <= 0 {
+				return nil, fmt.Errorf("rate_limit filter max_rate must be positive, got %.3f", cfg.MaxRate)
+			}
+			filters = append(filters, &rateLimitFilter{maxRate: cfg.MaxRate})
+		default:
+			return nil, fmt.Errorf("unknown filter type %q", cfg.Type)
+		}
+	}
+	return filters, nil
+}
+
+// applyFilters passes the reading through all filters
+func applyFilters(filters []TempFilter, temp float64, at time.Time) float64 {
+	for _, filter := range filters {
+		temp = filter.Apply(temp, at)
+	}
+	return temp
+}
+
+// medianFilter removes single-sample spikes
+type medianFilter struct {
+	window int
+	values []float64
+}
+
+// Apply returns the median of the last readings, including this one
+func (obj *medianFilter) Apply(temp float64, _ time.Time) float64 {
+	obj.values = append(obj.values, temp)
+	if len(obj.values) > obj.window {
+		obj.values = obj.values[1:]
+	}
+	sorted := append([]float64(nil), obj.values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// emaFilter smooths noise, a higher alpha follows the readings faster
+type emaFilter struct {
+	alpha  float64
+	value  float64
+	primed bool
+}
+
+// Apply returns the moving average updated with this reading
+func (obj *emaFilter) Apply(temp float64, _ time.Time) float64 {
+	if !obj.primed {
+		obj.value = temp
+		obj.primed = true
+		return temp
+	}
+	obj.value = obj.alpha*temp + (1-obj.alpha)*obj.value
+	return obj.value
+}
+
+// rateLimitFilter limits how fast the value may change
+type rateLimitFilter struct {
+	maxRate float64 // °C per minute
+	last    float64
+	lastAt  time.Time
+	primed  bool
+}
+
+// Apply returns the reading, clamped to the maximum change since the previous one
+func (obj *rateLimitFilter) Apply(temp float64, at time.Time) float64 {
+	if obj.primed {
+		maxStep := obj.maxRate * at.Sub(obj.lastAt).Minutes()
+		if temp > obj.last+maxStep {
+			temp = obj.last + maxStep
+		} else if temp < obj.last-maxStep {
+			temp = obj.last - maxStep
+		}
+	}
+	obj.last = temp
+	obj.lastAt = at
+	obj.primed = true
+	return temp
+}
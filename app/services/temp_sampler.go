@@ -0,0 +1,299 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"rpi-heating-system/app/config"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultPollInterval is the time between two reads of a sensor
+	defaultPollInterval = 30 * time.Second
+	// defaultReadTimeout is the time after which a single sensor read is given up
+	defaultReadTimeout = 5 * time.Second
+	// staleSampleIntervals is the number of poll intervals after which a cached value is considered stale
+	staleSampleIntervals = 3
+)
+
+var (
+	// ErrReadTimeout is returned when a sensor read does not finish within the read timeout
+	ErrReadTimeout = errors.New("sensor read timed out")
+	// ErrNoSample is returned when a sensor has no cached value yet
+	ErrNoSample = errors.New("no sample available")
+	// ErrStaleSample is returned when the cached value of a sensor is too old
+	ErrStaleSample = errors.New("sample is stale")
+)
+
+// TempSample is the cached state of a single sensor
+type TempSample struct {
+	Temp float64   // last successfully read temperature, after filtering
+	Raw  float64   // last successfully read temperature, before filtering
+	Time time.Time // time of the last successful read, zero if the sensor was never read successfully
+	Err  error     // error of the most recent read, nil if it succeeded
+}
+
+// TempPoint is a single successful reading in the sampling history
+type TempPoint struct {
+	Temp float64
+	Time time.Time
+}
+
+// SampleListener is called after every read of a sensor, successful or not
+type SampleListener func(sensorID string, sample TempSample)
+
+// TempSamplerService reads all configured sensors concurrently, each at its own interval, and caches the latest values
+// It implements TempSensorReader on top of the cache, so consumers never touch the sensors directly
+type TempSamplerService struct {
+	reader      TempSensorReader
+	sensorIDs   []string
+	intervals   map[string]time.Duration // poll interval, keyed by sensor ID
+	readTimeout time.Duration
+	mu          sync.Mutex
+	samples     map[string]*TempSample
+	filters     map[string][]TempFilter // filter pipeline, keyed by sensor ID
+	history     map[string][]TempPoint  // filtered readings within the retention, keyed by sensor ID
+	retention   time.Duration           // history is kept only for sensors with a trend
+	reading     map[string]bool         // sensors with a read still in progress, keyed by sensor ID
+	listeners   []SampleListener
+	observers   []TemperatureObserver
+	done        chan struct{}
+}
+
+// NewTempSamplerService creates a new TempSamplerService for all configured temperature sensors
+// Sampling begins with Start, so listeners registered before do not miss the first values
+func NewTempSamplerService(reader TempSensorReader, conf *config.AppConfig) (*TempSamplerService, error) {
+	s := &TempSamplerService{
+		reader:      reader,
+		intervals:   make(map[string]time.Duration),
+		readTimeout: defaultReadTimeout,
+		samples:     make(map[string]*TempSample),
+		filters:     make(map[string][]TempFilter),
+		history:     make(map[string][]TempPoint),
+		reading:     make(map[string]bool),
+		done:        make(chan struct{}),
+	}
+	if conf.TempSampling != nil && conf.TempSampling.ReadTimeoutMs > 0 {
+		s.readTimeout = time.Duration(conf.TempSampling.ReadTimeoutMs) * time.Millisecond
+	}
+	// keep as much history as the longest trend window needs
+	for _, trend := range conf.Trends {
+		window := trendWindow(trend)
+		if window > s.retention {
+			s.retention = window
+		}
+		s.history[trend.SensorID] = nil
+	}
+	for _, sensor := range conf.TempSensors {
+		s.sensorIDs = append(s.sensorIDs, sensor.ID)
+		s.intervals[sensor.ID] = sensorPollInterval(conf, sensor)
+		filters, err := newTempFilters(sensor.Filters)
+		if err != nil {
+			return nil, fmt.Errorf("sensor %s: %w", sensor.ID, err)
+		}
+		s.filters[sensor.ID] = filters
+	}
+	return s, nil
+}
+
+// Start samples all sensors once and then keeps sampling every sensor at its own interval
+func (obj *TempSamplerService) Start() {
+	obj.sweep()
+
+	for _, id := range obj.sensorIDs {
+		go obj.poll(id)
+	}
+}
+
+// AddListener registers a listener that receives the result of every sensor read
+func (obj *TempSamplerService) AddListener(listener SampleListener) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.listeners = append(obj.listeners, listener)
+}
+
+// AddTemperatureObserver registers an observer that receives every successful sensor reading
+// Observers receive the calibrated but unfiltered value
+func (obj *TempSamplerService) AddTemperatureObserver(observer TemperatureObserver) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.observers = append(obj.observers, observer)
+}
+
+// Sample returns the cached state of the sensor, false if the sensor was not sampled yet
+func (obj *TempSamplerService) Sample(id string) (TempSample, bool) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	sample, ok := obj.samples[id]
+	if !ok {
+		return TempSample{}, false
+	}
+	return *sample, true
+}
+
+// History returns the readings of the sensor taken since the given time, oldest first
+func (obj *TempSamplerService) History(id string, since time.Time) []TempPoint {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	var points []TempPoint
+	for _, point := range obj.history[id] {
+		if !point.Time.Before(since) {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// Interval returns the poll interval of the sensor
+func (obj *TempSamplerService) Interval(id string) time.Duration {
+	interval, ok := obj.intervals[id]
+	if !ok {
+		return defaultPollInterval
+	}
+	return interval
+}
+
+// Read returns the cached temperature of the sensor in °C
+// Values older than a few poll intervals are rejected, even if the sensor failed only recently
+func (obj *TempSamplerService) Read(id string) (float64, error) {
+	sample, ok := obj.Sample(id)
+	if !ok || sample.Time.IsZero() {
+		if ok && sample.Err != nil {
+			return 0.0, fmt.Errorf("no sample for sensor %s: %w", id, sample.Err)
+		}
+		return 0.0, fmt.Errorf("sensor %s: %w", id, ErrNoSample)
+	}
+	age := time.Since(sample.Time)
+	if age > staleSampleIntervals*obj.Interval(id) {
+		return 0.0, fmt.Errorf("sensor %s sampled %s ago: %w", id, age.Round(time.Second), ErrStaleSample)
+	}
+	return sample.Temp, nil
+}
+
+// Close stops sampling
+// Reads still in progress are not waited for
+func (obj *TempSamplerService) Close() error {
+	close(obj.done)
+	return nil
+}
+
+// sweep reads all sensors concurrently and waits until every read has finished or timed out
+func (obj *TempSamplerService) sweep() {
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, id := range obj.sensorIDs {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			obj.sample(id)
+		}(id)
+	}
+	wg.Wait()
+	log.Debug().Msgf("Temperature sweep finished in %s", time.Since(start))
+}
+
+// poll samples a single sensor periodically until the sampler is closed
+func (obj *TempSamplerService) poll(id string) {
+	ticker := time.NewTicker(obj.Interval(id))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-obj.done:
+			return
+		case <-ticker.C:
+			obj.sample(id)
+		}
+	}
+}
+
+// sample reads a single sensor within the read timeout, updates the cache and notifies listeners
+func (obj *TempSamplerService) sample(id string) {
+	type result struct {
+		temp float64
+		err  error
+	}
+	obj.mu.Lock()
+	// a stuck read is not stacked up, the sensor was already reported as timed out
+	if obj.reading[id] {
+		obj.mu.Unlock()
+		log.Warn().Msgf("Sensor %s read still in progress, skipping", id)
+		return
+	}
+	obj.reading[id] = true
+	obj.mu.Unlock()
+
+	// buffered, so the read goroutine can finish after a timeout
+	done := make(chan result, 1)
+	go func() {
+		temp, err := obj.reader.Read(id)
+		obj.mu.Lock()
+		obj.reading[id] = false
+		obj.mu.Unlock()
+		done <- result{temp: temp, err: err}
+	}()
+
+	var res result
+	timer := time.NewTimer(obj.readTimeout)
+	select {
+	case res = <-done:
+		timer.Stop()
+	case <-timer.C:
+		res.err = fmt.Errorf("sensor %s not read within %s: %w", id, obj.readTimeout, ErrReadTimeout)
+	}
+
+	obj.mu.Lock()
+	sample, ok := obj.samples[id]
+	if !ok {
+		sample = &TempSample{}
+		obj.samples[id] = sample
+	}
+	sample.Err = res.err
+	if res.err == nil {
+		sample.Time = time.Now()
+		sample.Raw = res.temp
+		sample.Temp = applyFilters(obj.filters[id], res.temp, sample.Time)
+		if history, ok := obj.history[id]; ok {
+			obj.history[id] = appendHistory(history, TempPoint{Temp: sample.Temp, Time: sample.Time}, obj.retention)
+		}
+	}
+	current := *sample
+	listeners := obj.listeners
+	observers := obj.observers
+	obj.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener(id, current)
+	}
+	if res.err != nil {
+		return
+	}
+	// safety rules must react to the real temperature, filters would delay or clamp a fast rise
+	for _, observer := range observers {
+		observer(id, current.Raw)
+	}
+}
+
+// sensorPollInterval returns the poll interval of the sensor, the sensor setting overrides the global one
+func sensorPollInterval(conf *config.AppConfig, sensor *config.TempSensorsConfig) time.Duration {
+	if sensor.PollInterval > 0 {
+		return time.Duration(sensor.PollInterval) * time.Second
+	}
+	if conf.TempSampling != nil && conf.TempSampling.PollInterval > 0 {
+		return time.Duration(conf.TempSampling.PollInterval) * time.Second
+	}
+	return defaultPollInterval
+}
+
+// appendHistory appends the point and drops points older than the retention
+func appendHistory(history []TempPoint, point TempPoint, retention time.Duration) []TempPoint {
+	history = append(history, point)
+	cutoff := point.Time.Add(-retention)
+	i := 0
+	for i < len(history) && history[i].Time.Before(cutoff) {
+		i++
+	}
+	return history[i:]
+}
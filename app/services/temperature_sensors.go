@@ -1,31 +1,372 @@
 package services
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"rpi-heating-system/app/config"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+// w1DevicesPath is the sysfs directory listing all devices on the 1-Wire bus
+const w1DevicesPath = "/sys/bus/w1/devices"
+
+// ds18b20Family is the 1-Wire family code prefix of DS18B20 sensor ROM IDs
+const ds18b20Family = "28-"
+
+const (
+	// ds18b20MinTemp and ds18b20MaxTemp limit the measuring range of a DS18B20 sensor
+	ds18b20MinTemp = -55.0
+	ds18b20MaxTemp = 125.0
+	// defaultCRCRetries is the number of additional reads after a failed one
+	defaultCRCRetries = 2
+	// defaultRetryDelay is the pause between retried reads
+	defaultRetryDelay = 100 * time.Millisecond
+	// bulkReadTimeout is the longest wait for a bulk conversion, 12 bit conversions take 750 ms
+	bulkReadTimeout = 2 * time.Second
+	// bulkReadMaxAge is the time after which a bulk conversion is too old to be read
+	bulkReadMaxAge = time.Second
+)
+
+// ds18b20Sentinels are raw values in millidegrees a DS18B20 reports without a real measurement
+var ds18b20Sentinels = map[float64]string{
+	85000:   "power-on reset value",
+	-127000: "disconnected sensor value",
+}
+
+var (
+	// ErrSensorNotFound is returned when the sensor is not present on the 1-Wire bus
+	ErrSensorNotFound = errors.New("sensor not found on the 1-wire bus")
+	// ErrCRC is returned when the sensor data fails the CRC check or is otherwise corrupted
+	ErrCRC = errors.New("sensor data CRC check failed")
+	// ErrOutOfRange is returned for sentinel values and values outside of the plausible sensor range
+	ErrOutOfRange = errors.New("sensor value out of range")
+)
+
+// SensorErrorCounters holds the number of failed reads of a single sensor by cause
+type SensorErrorCounters struct {
+	CRC        int
+	Missing    int
+	OutOfRange int
+}
+
+// SensorErrorCounter is implemented by temperature sensor readers that count read errors per sensor
+type SensorErrorCounter interface {
+	ErrorCounters(id string) SensorErrorCounters
+}
+
+// SensorDiscovery is the result of comparing sensors present on the bus with the configured ones
+type SensorDiscovery struct {
+	Unconfigured []string // sensors present on the bus but missing in the config
+	Missing      []string // configured sensors not present on the bus
+}
+
+// TemperatureObserver is called with every successful temperature reading
+type TemperatureObserver func(sensorID string, temp float64)
+
 type TempSensorReader interface {
 	Read(id string) (float64, error)
 }
 
+// sensorRange is the plausible temperature range of a sensor
+type sensorRange struct {
+	min float64
+	max float64
+}
+
+// DS18B20Service reads DS18B20 sensors through the w1_therm sysfs interface
+// Corrupted reads are retried, sentinel and implausible values are rejected and all failures are counted per sensor
 type DS18B20Service struct {
+	retries    int
+	retryDelay time.Duration
+	ranges     map[string]sensorRange
+	mu         sync.Mutex
+	counters   map[string]*SensorErrorCounters
+	resolution int
+	convTime   int
+	bulkRead   bool
+	bulkMu     sync.Mutex
+	bulkAt     time.Time       // completion time of the last bulk conversion
+	bulkFresh  map[string]bool // sensors that have not read the last bulk conversion yet
 }
 
-func NewDS18B20Service() *DS18B20Service {
-	return &DS18B20Service{}
+// NewDS18B20Service creates a new DS18B20Service with the retry settings and sensor ranges from the config
+func NewDS18B20Service(conf *config.AppConfig) *DS18B20Service {
+	ds := &DS18B20Service{
+		retries:    defaultCRCRetries,
+		retryDelay: defaultRetryDelay,
+		ranges:     make(map[string]sensorRange),
+		counters:   make(map[string]*SensorErrorCounters),
+		bulkFresh:  make(map[string]bool),
+	}
+	if conf.DS18B20 != nil {
+		if conf.DS18B20.CRCRetries != nil {
+			ds.retries = *conf.DS18B20.CRCRetries
+		}
+		if conf.DS18B20.RetryDelayMs > 0 {
+			ds.retryDelay = time.Duration(conf.DS18B20.RetryDelayMs) * time.Millisecond
+		}
+		ds.resolution = conf.DS18B20.Resolution
+		ds.convTime = conf.DS18B20.ConvTimeMs
+		ds.bulkRead = conf.DS18B20.BulkRead
+	}
+	for _, sensor := range conf.TempSensors {
+		r := sensorRange{min: ds18b20MinTemp, max: ds18b20MaxTemp}
+		if sensor.MinTemp != nil {
+			r.min = *sensor.MinTemp
+		}
+		if sensor.MaxTemp != nil {
+			r.max = *sensor.MaxTemp
+		}
+		ds.ranges[sensor.ID] = r
+	}
+	return ds
 }
 
+// ListSensors returns the ROM IDs of all DS18B20 sensors present on the 1-Wire bus
+func (obj *DS18B20Service) ListSensors() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(w1DevicesPath, ds18b20Family+"*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list 1-wire devices: %w", err)
+	}
+	ids := make([]string, 0, len(paths))
+	for _, path := range paths {
+		ids = append(ids, filepath.Base(path))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Discover compares the sensors present on the 1-Wire bus with the configured DS18B20 sensors
+func (obj *DS18B20Service) Discover(configured []*config.TempSensorsConfig) (*SensorDiscovery, error) {
+	present, err := obj.ListSensors()
+	if err != nil {
+		return nil, err
+	}
+
+	discovery := &SensorDiscovery{}
+	known := make(map[string]bool)
+	var ds18b20s []*config.TempSensorsConfig
+	for _, sensor := range configured {
+		known[sensor.ID] = true
+		if sensor.DriverType() == config.SensorTypeDS18B20 {
+			ds18b20s = append(ds18b20s, sensor)
+		}
+	}
+	onBus := make(map[string]bool)
+	for _, id := range present {
+		onBus[id] = true
+		if !known[id] {
+			discovery.Unconfigured = append(discovery.Unconfigured, id)
+		}
+	}
+	for _, sensor := range ds18b20s {
+		if !onBus[sensor.ID] {
+			discovery.Missing = append(discovery.Missing, sensor.ID)
+		}
+	}
+	return discovery, nil
+}
+
+// Configure writes the resolution and conversion time of the sensors and checks the bulk read support
+// Kernels without the sysfs attributes keep the sensor defaults and read every sensor on its own
+func (obj *DS18B20Service) Configure(sensors []*config.TempSensorsConfig) {
+	for _, sensor := range sensors {
+		if sensor.DriverType() != config.SensorTypeDS18B20 {
+			continue
+		}
+		resolution := obj.resolution
+		if sensor.Resolution != 0 {
+			resolution = sensor.Resolution
+		}
+		if resolution != 0 {
+			if resolution < 9 || resolution > 12 {
+				log.Error().Msgf("Sensor %s resolution %d is not within 9-12 bit", sensor.ID, resolution)
+			} else {
+				obj.writeAttribute(sensor.ID, "resolution", strconv.Itoa(resolution))
+			}
+		}
+		if obj.convTime != 0 {
+			obj.writeAttribute(sensor.ID, "conv_time", strconv.Itoa(obj.convTime))
+		}
+	}
+
+	if !obj.bulkRead {
+		return
+	}
+	masters, err := obj.bulkReadMasters()
+	if err != nil || len(masters) == 0 {
+		log.Warn().Msgf("Bulk read is not supported by the kernel, reading sensors one by one")
+		obj.bulkRead = false
+	}
+}
+
+// writeAttribute writes a w1_therm sysfs attribute of a sensor
+func (obj *DS18B20Service) writeAttribute(id string, name string, value string) {
+	path := filepath.Join(w1DevicesPath, id, name)
+	err := writeSysfs(path, value)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Warn().Msgf("Sensor %s %s is not supported by the kernel or the sensor is missing", id, name)
+		return
+	}
+	if err != nil {
+		log.Error().Msgf("failed to set sensor %s %s to %s: %s", id, name, value, err)
+		return
+	}
+	log.Info().Msgf("Sensor %s %s set to %s", id, name, value)
+}
+
+// bulkReadMasters returns the therm_bulk_read attributes of all 1-Wire bus masters
+func (obj *DS18B20Service) bulkReadMasters() ([]string, error) {
+	return filepath.Glob(filepath.Join(w1DevicesPath, "w1_bus_master*", "therm_bulk_read"))
+}
+
+// awaitBulkConversion makes sure a bulk conversion not yet read by the sensor is available
+// Concurrent reads share a single conversion, a sensor reading it for the second time triggers a new one
+func (obj *DS18B20Service) awaitBulkConversion(id string) error {
+	obj.bulkMu.Lock()
+	defer obj.bulkMu.Unlock()
+
+	if obj.bulkFresh[id] && time.Since(obj.bulkAt) < bulkReadMaxAge {
+		delete(obj.bulkFresh, id)
+		return nil
+	}
+
+	masters, err := obj.bulkReadMasters()
+	if err != nil {
+		return err
+	}
+	if len(masters) == 0 {
+		return errors.New("no bus master supports bulk read")
+	}
+	for _, master := range masters {
+		err := writeSysfs(master, "trigger")
+		if err != nil {
+			return fmt.Errorf("failed to trigger bulk conversion on %s: %w", master, err)
+		}
+	}
+
+	// therm_bulk_read reads -1 while the conversion is in progress
+	deadline := time.Now().Add(bulkReadTimeout)
+	for _, master := range masters {
+		for {
+			state, err := os.ReadFile(master)
+			if err != nil {
+				return fmt.Errorf("failed to read bulk conversion state of %s: %w", master, err)
+			}
+			if strings.TrimSpace(string(state)) != "-1" {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("bulk conversion on %s did not finish within %s", master, bulkReadTimeout)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// the conversion is started on every sensor of the bus
+	obj.bulkAt = time.Now()
+	obj.bulkFresh = make(map[string]bool)
+	present, err := obj.ListSensors()
+	if err != nil {
+		log.Warn().Msgf("Sensors converted by the bulk read are unknown: %s", err)
+	}
+	for _, sensorID := range present {
+		obj.bulkFresh[sensorID] = true
+	}
+	delete(obj.bulkFresh, id)
+	return nil
+}
+
+// writeSysfs writes a value to an existing sysfs attribute
+func writeSysfs(path string, value string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(value)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ErrorCounters returns the number of failed reads of the sensor by cause
+func (obj *DS18B20Service) ErrorCounters(id string) SensorErrorCounters {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	counters, ok := obj.counters[id]
+	if !ok {
+		return SensorErrorCounters{}
+	}
+	return *counters
+}
+
+// Read returns the temperature of the sensor in °C
+// Failed reads are retried with a conversion of the sensor alone, except for sensors missing on the bus
 func (obj *DS18B20Service) Read(id string) (float64, error) {
+	// without a pending bulk conversion the sensor converts on its own
+	if obj.bulkRead {
+		err := obj.awaitBulkConversion(id)
+		if err != nil {
+			log.Warn().Msgf("Bulk conversion failed, reading sensor %s on its own: %s", id, err)
+		}
+	}
+
+	var err error
+	for attempt := 0; attempt <= obj.retries; attempt++ {
+		if attempt > 0 {
+			log.Debug().Msgf("Retrying sensor %s read after: %s", id, err)
+			time.Sleep(obj.retryDelay)
+		}
+		var temp float64
+		temp, err = obj.readOnce(id)
+		if err == nil {
+			return temp, nil
+		}
+		obj.countError(id, err)
+		if errors.Is(err, ErrSensorNotFound) {
+			break
+		}
+	}
+	return 0.0, err
+}
+
+// countError increments the error counter matching the cause of the failed read
+func (obj *DS18B20Service) countError(id string, err error) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	counters, ok := obj.counters[id]
+	if !ok {
+		counters = &SensorErrorCounters{}
+		obj.counters[id] = counters
+	}
+	switch {
+	case errors.Is(err, ErrSensorNotFound):
+		counters.Missing++
+	case errors.Is(err, ErrOutOfRange):
+		counters.OutOfRange++
+	default:
+		counters.CRC++
+	}
+}
+
+// readOnce reads and validates the sensor value once
+func (obj *DS18B20Service) readOnce(id string) (float64, error) {
 	log.Debug().Msgf("Reading sensor state %s", id)
-	path := filepath.Join("/sys/bus/w1/devices", id, "w1_slave")
+	path := filepath.Join(w1DevicesPath, id, "w1_slave")
 	data, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0.0, fmt.Errorf("failed to read sensor %s: %w", id, ErrSensorNotFound)
+	}
 	if err != nil {
 		return 0.0, fmt.Errorf("failed to read sensor temp on path %s err: %w", path, err)
 	}
@@ -40,18 +381,36 @@ func (obj *DS18B20Service) Read(id string) (float64, error) {
 	raw := string(bytes)
 
 	if !strings.Contains(raw, " YES") {
-		return 0.0, fmt.Errorf("check CRC failed for sensor %s err: %w", id, err)
+		return 0.0, fmt.Errorf("check CRC failed for sensor %s err: %w", id, ErrCRC)
+	}
+	// a sensor with a broken data line returns an all-zero scratchpad which passes the CRC check
+	if strings.HasPrefix(raw, "00 00 00 00 00 00 00 00 00") {
+		return 0.0, fmt.Errorf("empty scratchpad for sensor %s err: %w", id, ErrCRC)
 	}
 
 	i := strings.LastIndex(raw, "t=")
 	if i == -1 {
-		return 0.0, fmt.Errorf("temperature value not exist for sensor %s err: %w", id, err)
+		return 0.0, fmt.Errorf("temperature value not exist for sensor %s err: %w", id, ErrCRC)
 	}
 
-	c, err := strconv.ParseFloat(raw[i+2:len(raw)-1], 64)
+	c, err := strconv.ParseFloat(strings.TrimSpace(raw[i+2:]), 64)
 	if err != nil {
-		return 0.0, fmt.Errorf("failed to parse temperature for sensor %s err: %w", id, err)
+		return 0.0, fmt.Errorf("failed to parse temperature for sensor %s err: %s: %w", id, err, ErrCRC)
+	}
+
+	// a real temperature hits exactly 85.000 °C only briefly, the power-on value is far more likely
+	if reason, ok := ds18b20Sentinels[c]; ok {
+		return 0.0, fmt.Errorf("sensor %s returned %s %.3f err: %w", id, reason, c/1000.0, ErrOutOfRange)
+	}
+
+	temp := c / 1000.0
+	r, ok := obj.ranges[id]
+	if !ok {
+		r = sensorRange{min: ds18b20MinTemp, max: ds18b20MaxTemp}
+	}
+	if temp < r.min || temp > r.max {
+		return 0.0, fmt.Errorf("sensor %s value %.3f outside of %.1f..%.1f err: %w", id, temp, r.min, r.max, ErrOutOfRange)
 	}
 
-	return c / 1000.0, nil
+	return temp, nil
 }
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"rpi-heating-system/app/config"
+	"sync"
+	"time"
+)
+
+// defaultTrendWindow is the history the rate of change is calculated from
+const defaultTrendWindow = 5 * time.Minute
+
+// ErrNotEnoughHistory is returned when the sampling history is too short for a rate of change
+var ErrNotEnoughHistory = errors.New("not enough history")
+
+// TrendReading holds the rate of change of a sensor and the state of the linked activity
+type TrendReading struct {
+	RatePerMinute float64 // °C per minute
+	Active        bool    // activity state, valid only if the trend has an activity
+}
+
+// trend is a single rate of change sensor
+type trend struct {
+	cfg    *config.TrendConfig
+	window time.Duration
+	active bool
+}
+
+// TrendService calculates the rate of change of sensors from the sampling history
+// and drives activity states like "Oven Fire Active" from it
+type TrendService struct {
+	sampler *TempSamplerService
+	mu      sync.Mutex
+	trends  map[int]*trend
+}
+
+// NewTrendService creates a new TrendService for all configured trend sensors
+func NewTrendService(sampler *TempSamplerService, conf *config.AppConfig) (*TrendService, error) {
+	ts := &TrendService{
+		sampler: sampler,
+		trends:  make(map[int]*trend),
+	}
+
+	sensors := make(map[string]bool)
+	for _, sensor := range conf.TempSensors {
+		sensors[sensor.ID] = true
+	}
+
+	for _, cfg := range conf.Trends {
+		if !sensors[cfg.SensorID] {
+			return nil, fmt.Errorf("trend %s sensor %s does not exist", cfg.Name, cfg.SensorID)
+		}
+		if _, ok := ts.trends[cfg.ID]; ok {
+			return nil, fmt.Errorf("trend id %d is not unique", cfg.ID)
+		}
+		if cfg.Activity != nil && cfg.Activity.FallRate >= cfg.Activity.RiseRate {
+			return nil, fmt.Errorf("trend %s fall rate must be lower than rise rate", cfg.Name)
+		}
+		ts.trends[cfg.ID] = &trend{
+			cfg:    cfg,
+			window: trendWindow(cfg),
+		}
+	}
+	return ts, nil
+}
+
+// Calculate returns the current rate of change of the trend with the specified ID and updates its activity
+// Without enough history, e.g. after the sensor failed, the activity is reset and ErrNotEnoughHistory is returned
+func (obj *TrendService) Calculate(id int) (TrendReading, error) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+
+	t, ok := obj.trends[id]
+	if !ok {
+		return TrendReading{}, fmt.Errorf("trend %d does not exist", id)
+	}
+
+	points := obj.sampler.History(t.cfg.SensorID, time.Now().Add(-t.window))
+	rate, err := ratePerMinute(points, t.window)
+	if err != nil {
+		// an activity without readings must not stay latched
+		t.active = false
+		return TrendReading{}, fmt.Errorf("trend %s: %w", t.cfg.Name, err)
+	}
+
+	activity := t.cfg.Activity
+	if activity != nil {
+		last := points[len(points)-1].Temp
+		switch {
+		case activity.MinTemp != nil && last < *activity.MinTemp:
+			t.active = false
+		case rate >= activity.RiseRate:
+			t.active = true
+		case rate <= activity.FallRate:
+			t.active = false
+		}
+	}
+	return TrendReading{RatePerMinute: rate, Active: t.active}, nil
+}
+
+// ratePerMinute fits a line through the points and returns its slope in °C per minute
+// The points must span at least a quarter of the window, so a single noisy pair does not dominate
+func ratePerMinute(points []TempPoint, window time.Duration) (float64, error) {
+	if len(points) < 2 || points[len(points)-1].Time.Sub(points[0].Time) < window/4 {
+		return 0.0, ErrNotEnoughHistory
+	}
+	start := points[0].Time
+	var sumX, sumY, sumXY, sumXX float64
+	for _, point := range points {
+		x := point.Time.Sub(start).Minutes()
+		sumX += x
+		sumY += point.Temp
+		sumXY += x * point.Temp
+		sumXX += x * x
+	}
+	n := float64(len(points))
+	return (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX), nil
+}
+
+// trendWindow returns the configured history window of the trend
+func trendWindow(cfg *config.TrendConfig) time.Duration {
+	if cfg.Window <= 0 {
+		return defaultTrendWindow
+	}
+	return time.Duration(cfg.Window) * time.Second
+}
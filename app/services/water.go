@@ -0,0 +1,5 @@
+package services
+
+// waterHeatCapacity is the specific heat capacity of water in kJ/(kg*K)
+// Heat calculations assume 1 kg of water per liter
+const waterHeatCapacity = 4.186
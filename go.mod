@@ -7,6 +7,7 @@ require (
 	github.com/json-iterator/go v1.1.12
 	github.com/rs/zerolog v1.30.0
 	github.com/warthog618/gpiod v0.8.2
+	golang.org/x/sys v0.10.0
 )
 
 require (
@@ -18,5 +19,4 @@ require (
 	github.com/stretchr/testify v1.8.3 // indirect
 	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
-	golang.org/x/sys v0.10.0 // indirect
 )
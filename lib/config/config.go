@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
 	jsoniter "github.com/json-iterator/go"
 )
@@ -29,3 +30,41 @@ func LoadConfigFromFile(filename string, confStruct any) error {
 
 	return nil
 }
+
+// SaveConfigToFile marshals 'confStruct' to indented JSON and writes it to the file specified by 'filename'.
+// The file is replaced atomically and keeps its permissions, so a failed write never leaves a truncated config behind.
+func SaveConfigToFile(filename string, confStruct any) error {
+	byteResult, err := jsoniter.MarshalIndent(confStruct, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON data: %w", err)
+	}
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create config file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(byteResult, '\n'))
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	err = os.Rename(tmp.Name(), filename)
+	if err != nil {
+		return fmt.Errorf("failed to replace config file: %w", err)
+	}
+	return nil
+}
@@ -4,5 +4,8 @@ import "io"
 
 // HAController is an interface for the Home Assistant controller
 type HAController interface {
+	// Announce publishes discovery configs, availability and last known states to Home Assistant
+	// and (re)subscribes to command topics. It is called again every time the MQTT connection is re-established
+	Announce() error
 	io.Closer
 }
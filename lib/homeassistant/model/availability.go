@@ -0,0 +1,18 @@
+package model
+
+// AvailabilityMode controls how Home Assistant combines multiple availability topics
+type AvailabilityMode string
+
+// Constants representing the possible availability modes
+const (
+	AvailabilityModeAll    AvailabilityMode = "all"    // Entity is available only if all topics are online
+	AvailabilityModeAny    AvailabilityMode = "any"    // Entity is available if any topic is online
+	AvailabilityModeLatest AvailabilityMode = "latest" // The last received message on any topic wins
+)
+
+// Availability represents a single availability topic of an entity in Home Assistant
+type Availability struct {
+	Topic               string `json:"topic"`                           // MQTT topic to receive availability status
+	PayloadAvailable    string `json:"payload_available,omitempty"`     // Payload representing available state, default "online"
+	PayloadNotAvailable string `json:"payload_not_available,omitempty"` // Payload representing unavailable state, default "offline"
+}
@@ -2,10 +2,16 @@ package model
 
 // BinarySensor represents a binary sensor entity in Home Assistant.
 type BinarySensor struct {
-	Schema            string  `json:"schema"` // e.g., "json"
-	UniqueID          string  `json:"unique_id"`
-	Name              string  `json:"name"`
-	Device            *Device `json:"device,omitempty"`
-	StateTopic        string  `json:"state_topic"`
-	AvailabilityTopic string  `json:"availability_topic,omitempty"`
+	Schema           string           `json:"schema"` // e.g., "json"
+	UniqueID         string           `json:"unique_id"`
+	Name             string           `json:"name"`
+	Device           *Device          `json:"device,omitempty"`
+	StateTopic       string           `json:"state_topic"`
+	Availability     []*Availability  `json:"availability,omitempty"`
+	AvailabilityMode AvailabilityMode `json:"availability_mode,omitempty"`
+	DeviceClass      string           `json:"device_class,omitempty"` // e.g., "heat", "cold", "problem"
+	EntityCategory   EntityCategory   `json:"entity_category,omitempty"`
+	Icon             string           `json:"icon,omitempty"`
+	// MQTT topic to publish additional JSON attributes of the binary sensor
+	JSONAttributesTopic string `json:"json_attributes_topic,omitempty"`
 }
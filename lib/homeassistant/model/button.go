@@ -0,0 +1,14 @@
+package model
+
+// Button represents a button entity in Home Assistant.
+type Button struct {
+	Schema           string           `json:"schema"`                      // Schema type for the button entity
+	UniqueID         string           `json:"unique_id"`                   // Unique ID for the button entity
+	Name             string           `json:"name"`                        // Name of the button entity
+	Device           *Device          `json:"device,omitempty"`            // Associated device information
+	CommandTopic     string           `json:"command_topic"`               // MQTT topic to receive presses
+	PayloadPress     string           `json:"payload_press,omitempty"`     // Payload sent on a press, "PRESS" by default
+	Availability     []*Availability  `json:"availability,omitempty"`      // Availability topics of the button entity
+	AvailabilityMode AvailabilityMode `json:"availability_mode,omitempty"` // How availability topics are combined
+	Icon             string           `json:"icon,omitempty"`              // Icon of the entity, e.g. "mdi:play"
+}
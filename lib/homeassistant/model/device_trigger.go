@@ -0,0 +1,11 @@
+package model
+
+// DeviceTrigger represents an MQTT device trigger in Home Assistant, usable in device automations
+type DeviceTrigger struct {
+	AutomationType string  `json:"automation_type"`   // always "trigger"
+	Topic          string  `json:"topic"`             // MQTT topic the trigger payload is published to
+	Type           string  `json:"type"`              // e.g., "button_short_press", "button_long_press"
+	Subtype        string  `json:"subtype"`           // e.g., "button_1"
+	Payload        string  `json:"payload,omitempty"` // payload that fires the trigger, any payload if empty
+	Device         *Device `json:"device"`            // device the trigger belongs to, required by Home Assistant
+}
@@ -0,0 +1,20 @@
+package model
+
+// Event represents an event entity in Home Assistant
+// The state topic receives JSON messages with the event type, see EventMessage
+type Event struct {
+	UniqueID         string           `json:"unique_id"`
+	Name             string           `json:"name"`
+	Device           *Device          `json:"device,omitempty"`
+	StateTopic       string           `json:"state_topic"`
+	Availability     []*Availability  `json:"availability,omitempty"`
+	AvailabilityMode AvailabilityMode `json:"availability_mode,omitempty"`
+	EventTypes       []string         `json:"event_types"`
+	DeviceClass      string           `json:"device_class,omitempty"` // e.g., "button", "doorbell"
+	Icon             string           `json:"icon,omitempty"`
+}
+
+// EventMessage represents a single event of an event entity
+type EventMessage struct {
+	EventType string `json:"event_type"`
+}
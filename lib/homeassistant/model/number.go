@@ -0,0 +1,30 @@
+package model
+
+// NumberMode represents how a number entity is shown in Home Assistant
+type NumberMode string
+
+// Constants representing the possible number modes
+const (
+	NumberModeAuto   NumberMode = "auto"   // Home Assistant decides between box and slider
+	NumberModeBox    NumberMode = "box"    // Value is entered in an input field
+	NumberModeSlider NumberMode = "slider" // Value is set with a slider
+)
+
+// Number represents a number entity in Home Assistant.
+type Number struct {
+	Schema            string           `json:"schema"`                        // Schema type for the number entity
+	UniqueID          string           `json:"unique_id"`                     // Unique ID for the number entity
+	Name              string           `json:"name"`                          // Name of the number entity
+	Device            *Device          `json:"device,omitempty"`              // Associated device information
+	StateTopic        string           `json:"state_topic"`                   // MQTT topic to publish the number value
+	CommandTopic      string           `json:"command_topic"`                 // MQTT topic to receive new values
+	Availability      []*Availability  `json:"availability,omitempty"`        // Availability topics of the number entity
+	AvailabilityMode  AvailabilityMode `json:"availability_mode,omitempty"`   // How availability topics are combined
+	Min               float64          `json:"min"`                           // Minimum accepted value
+	Max               float64          `json:"max"`                           // Maximum accepted value
+	Step              float64          `json:"step,omitempty"`                // Step between values
+	Mode              NumberMode       `json:"mode,omitempty"`                // How the number is shown
+	UnitOfMeasurement string           `json:"unit_of_measurement,omitempty"` // Unit of the value
+	EntityCategory    EntityCategory   `json:"entity_category,omitempty"`     // Category of non-primary entities
+	Icon              string           `json:"icon,omitempty"`                // Icon of the entity, e.g. "mdi:timer"
+}
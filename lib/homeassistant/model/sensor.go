@@ -1,11 +1,49 @@
 package model
 
 type TemperatureSensor struct {
-	Schema            string  `json:"schema"` // e.g., "json"
-	UniqueID          string  `json:"unique_id"`
-	Name              string  `json:"name"`
-	Device            *Device `json:"device,omitempty"`
-	StateTopic        string  `json:"state_topic"`
-	AvailabilityTopic string  `json:"availability_topic,omitempty"`
-	UnitOfMeasurement string  `json:"unit_of_measurement,omitempty"`
+	Schema            string           `json:"schema"` // e.g., "json"
+	UniqueID          string           `json:"unique_id"`
+	Name              string           `json:"name"`
+	Device            *Device          `json:"device,omitempty"`
+	StateTopic        string           `json:"state_topic"`
+	Availability      []*Availability  `json:"availability,omitempty"`
+	AvailabilityMode  AvailabilityMode `json:"availability_mode,omitempty"`
+	UnitOfMeasurement string           `json:"unit_of_measurement,omitempty"`
+	ExpireAfter       int              `json:"expire_after,omitempty"` // seconds after which the value becomes unavailable if not updated
+}
+
+// StateClass represents the state class of a sensor entity in Home Assistant
+type StateClass string
+
+// Constants representing the possible sensor state classes
+const (
+	StateClassMeasurement     StateClass = "measurement"      // Value is a current measurement, e.g. temperature
+	StateClassTotal           StateClass = "total"            // Value is a total amount that can increase and decrease
+	StateClassTotalIncreasing StateClass = "total_increasing" // Value is a monotonically increasing total, e.g. energy meter
+)
+
+// EntityCategory represents the category of a non-primary entity in Home Assistant
+type EntityCategory string
+
+// Constants representing the possible entity categories
+const (
+	EntityCategoryConfig     EntityCategory = "config"     // Entity allows changing the device configuration
+	EntityCategoryDiagnostic EntityCategory = "diagnostic" // Entity exposes diagnostic information about the device
+)
+
+// Sensor represents a generic sensor entity in Home Assistant.
+type Sensor struct {
+	Schema            string           `json:"schema"`                        // Schema type for the sensor entity
+	UniqueID          string           `json:"unique_id"`                     // Unique ID for the sensor entity
+	Name              string           `json:"name"`                          // Name of the sensor entity
+	Device            *Device          `json:"device,omitempty"`              // Associated device information
+	StateTopic        string           `json:"state_topic"`                   // MQTT topic to publish the sensor state
+	Availability      []*Availability  `json:"availability,omitempty"`        // Availability topics of the sensor entity
+	AvailabilityMode  AvailabilityMode `json:"availability_mode,omitempty"`   // How availability topics are combined
+	DeviceClass       string           `json:"device_class,omitempty"`        // Type of the sensor, e.g. "energy", "duration", "enum"
+	StateClass        StateClass       `json:"state_class,omitempty"`         // State class used by long term statistics
+	UnitOfMeasurement string           `json:"unit_of_measurement,omitempty"` // Unit of the sensor value
+	EntityCategory    EntityCategory   `json:"entity_category,omitempty"`     // Category of non-primary entities
+	Icon              string           `json:"icon,omitempty"`                // Icon of the entity, e.g. "mdi:pump"
+	Options           []string         `json:"options,omitempty"`             // Possible states of an "enum" sensor
 }
@@ -11,14 +11,17 @@ const (
 
 // Switch represents a switch entity in Home Assistant.
 type Switch struct {
-	Schema            string     `json:"schema"`                       // Schema type for the switch entity
-	Device            *Device    `json:"device,omitempty"`             // Associated device information
-	Name              string     `json:"name"`                         // Name of the switch entity
-	StateTopic        string     `json:"state_topic"`                  // MQTT topic to publish the switch state
-	CommandTopic      string     `json:"command_topic"`                // MQTT topic to receive switch commands
-	UniqueID          string     `json:"unique_id,omitempty"`          // Unique ID for the switch entity
-	DeviceClass       SwitchType `json:"device_class,omitempty"`       // Type of the switch device
-	AvailabilityTopic string     `json:"availability_topic,omitempty"` // MQTT topic to publish availability status
+	Schema           string           `json:"schema"`                      // Schema type for the switch entity
+	Device           *Device          `json:"device,omitempty"`            // Associated device information
+	Name             string           `json:"name"`                        // Name of the switch entity
+	StateTopic       string           `json:"state_topic"`                 // MQTT topic to publish the switch state
+	CommandTopic     string           `json:"command_topic"`               // MQTT topic to receive switch commands
+	UniqueID         string           `json:"unique_id,omitempty"`         // Unique ID for the switch entity
+	DeviceClass      SwitchType       `json:"device_class,omitempty"`      // Type of the switch device
+	Availability     []*Availability  `json:"availability,omitempty"`      // Availability topics of the switch entity
+	AvailabilityMode AvailabilityMode `json:"availability_mode,omitempty"` // How availability topics are combined
+	// MQTT topic to publish additional JSON attributes of the switch entity
+	JSONAttributesTopic string `json:"json_attributes_topic,omitempty"`
 }
 
 // HASwitchMessage represents the state message for a switch entity in Home Assistant.
@@ -2,38 +2,172 @@ package homeassistant
 
 import (
 	"fmt"
-	"rpi-heating-system/lib"
+	"sync"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultMaxReconnectInterval is the upper limit of the reconnect backoff if not configured
+	defaultMaxReconnectInterval = 60 * time.Second
+	// defaultAvailabilityTopic is the device availability topic if not configured
+	defaultAvailabilityTopic = "rpi-heating-controller/availability"
+	// defaultHAStatusTopic is the topic where Home Assistant publishes its birth and will messages
+	defaultHAStatusTopic = "homeassistant/status"
 )
 
 // MqttConfig holds the configuration settings for the MQTT client used in Home Assistant communication
 type MqttConfig struct {
-	Addr     string `json:"addr"`     // Address of the MQTT broker, e.g., "tcp://192.168.0.100:1883"
-	Username string `json:"username"` // Username for MQTT authentication
-	Password string `json:"password"` // Password for MQTT authentication
+	Addr                 string `json:"addr"`                             // Address of the MQTT broker, e.g., "tcp://192.168.0.100:1883"
+	Username             string `json:"username"`                         // Username for MQTT authentication
+	Password             string `json:"password"`                         // Password for MQTT authentication
+	MaxReconnectInterval int    `json:"max_reconnect_interval,omitempty"` // Maximum backoff between reconnect attempts in seconds
+	AvailabilityTopic    string `json:"availability_topic,omitempty"`     // Device availability topic, also used as the Last Will topic
+	HAStatusTopic        string `json:"ha_status_topic,omitempty"`        // Home Assistant birth message topic, default "homeassistant/status"
+}
+
+// DeviceAvailabilityTopic returns the topic where the availability of the whole device is published
+// The broker publishes "offline" to it as the Last Will if the controller disappears without disconnecting.
+// Every controller lists it next to the availability topic of its entities, so all entities go unavailable together
+func (c *MqttConfig) DeviceAvailabilityTopic() string {
+	if c.AvailabilityTopic != "" {
+		return c.AvailabilityTopic
+	}
+	return defaultAvailabilityTopic
+}
+
+// HAMqttClient is an MQTT client for communication with Home Assistant
+// It reconnects automatically when the connection is lost and replays announcements of all registered controllers
+type HAMqttClient struct {
+	MQTT.Client
+	availabilityTopic string
+	haStatusTopic     string
+	mu                sync.Mutex
+	announceMu        sync.Mutex // serializes announcements triggered by reconnects and birth messages
+	controllers       []HAController
+	connected         bool
 }
 
 // NewHAMqttClient creates a new MQTT client for communication with Home Assistant
-// It takes the MqttConfig as input and returns an MQTT.Client instance or an error if connection fails
-func NewHAMqttClient(conf *MqttConfig) (MQTT.Client, error) {
+// It takes the MqttConfig as input and returns an HAMqttClient instance or an error if connection fails
+func NewHAMqttClient(conf *MqttConfig) (*HAMqttClient, error) {
+	maxReconnectInterval := defaultMaxReconnectInterval
+	if conf.MaxReconnectInterval > 0 {
+		maxReconnectInterval = time.Duration(conf.MaxReconnectInterval) * time.Second
+	}
+
+	c := &HAMqttClient{
+		availabilityTopic: conf.DeviceAvailabilityTopic(),
+		haStatusTopic:     conf.HAStatusTopic,
+	}
+	if c.haStatusTopic == "" {
+		c.haStatusTopic = defaultHAStatusTopic
+	}
+
 	// Create MQTT client options and set the provided configuration settings
 	opts := MQTT.NewClientOptions().AddBroker(conf.Addr)
 	opts.SetUsername(conf.Username)
 	opts.SetPassword(conf.Password)
 	opts.SetClientID("rpi-heating-controller")
-	opts.OnConnectionLost = func(client MQTT.Client, err error) {
-		// If the MQTT connection is lost, panic with the error using the Panic utility function from the lib package
-		lib.Panic(fmt.Errorf("mqtt-event connection lost %w", err))
-	}
-	client := MQTT.NewClient(opts)
+	// the broker marks the whole device as offline if the connection drops without a proper disconnect
+	opts.SetWill(c.availabilityTopic, "offline", 1, true)
+	// paho doubles the delay between attempts up to the max reconnect interval
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(maxReconnectInterval)
+	opts.SetConnectionLostHandler(func(client MQTT.Client, err error) {
+		// Pumps keep their GPIO state, only the communication with Home Assistant is interrupted
+		log.Warn().Msgf("mqtt-event connection lost, reconnecting: %s", err)
+	})
+	opts.SetReconnectingHandler(func(client MQTT.Client, opts *MQTT.ClientOptions) {
+		log.Info().Msg("mqtt-event trying to reconnect")
+	})
+	opts.SetOnConnectHandler(c.onConnect)
+	c.Client = MQTT.NewClient(opts)
 
 	// Connect to the MQTT broker
-	token := client.Connect()
+	token := c.Connect()
 	if token.Wait(); token.Error() != nil {
 		return nil, fmt.Errorf("failed to connect to MQTT broker, %w", token.Error())
 	}
 
 	// Return the MQTT client instance if the connection is successful
-	return client, nil
+	return c, nil
+}
+
+// RegisterController registers a controller whose announcement is replayed after every reconnect
+func (obj *HAMqttClient) RegisterController(ctl HAController) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	obj.controllers = append(obj.controllers, ctl)
+}
+
+// Disconnect marks the device as offline and ends the connection with the broker
+func (obj *HAMqttClient) Disconnect(quiesce uint) {
+	if obj.IsConnectionOpen() {
+		token := obj.Publish(obj.availabilityTopic, 1, true, "offline")
+		if !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+			log.Error().Msgf("failed to publish device offline state: %s", token.Error())
+		}
+	}
+	obj.Client.Disconnect(quiesce)
+}
+
+// onConnect is called by paho on the initial connect and on every successful reconnect
+func (obj *HAMqttClient) onConnect(client MQTT.Client) {
+	obj.mu.Lock()
+	reconnect := obj.connected
+	obj.connected = true
+	obj.mu.Unlock()
+
+	// overwrite the retained Last Will message
+	token := client.Publish(obj.availabilityTopic, 1, true, "online")
+	if !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+		log.Error().Msgf("failed to publish device availability: %s", token.Error())
+	}
+
+	// subscriptions are not kept by the broker between sessions, subscribe on every connect
+	token = client.Subscribe(obj.haStatusTopic, 1, obj.onHAStatus)
+	if token.Wait() && token.Error() != nil {
+		log.Error().Msgf("failed to subscribe to Home Assistant status topic: %s", token.Error())
+	}
+
+	if !reconnect {
+		log.Info().Msg("mqtt-event connected")
+		return
+	}
+	log.Info().Msg("mqtt-event reconnected, announcing controllers")
+	obj.announceAll()
+}
+
+// onHAStatus is a callback for Home Assistant birth and will messages
+// When Home Assistant comes online it has forgotten all entities that were not retained, so everything is announced again
+func (obj *HAMqttClient) onHAStatus(client MQTT.Client, msg MQTT.Message) {
+	log.Debug().Msgf("Rx HA status: Payload: [%s], Retained: [%t]", msg.Payload(), msg.Retained())
+	// a retained birth message is not a restart, the connect handler takes care of the initial announcement
+	if msg.Retained() || string(msg.Payload()) != "online" {
+		return
+	}
+	log.Info().Msg("Home Assistant started, announcing controllers")
+	// announcing waits on publish tokens, it must not block the paho message router
+	go obj.announceAll()
+}
+
+// announceAll calls Announce on all registered controllers
+func (obj *HAMqttClient) announceAll() {
+	obj.announceMu.Lock()
+	defer obj.announceMu.Unlock()
+
+	obj.mu.Lock()
+	controllers := make([]HAController, len(obj.controllers))
+	copy(controllers, obj.controllers)
+	obj.mu.Unlock()
+
+	for _, ctl := range controllers {
+		err := ctl.Announce()
+		if err != nil {
+			log.Error().Msgf("failed to announce controller: %s", err)
+		}
+	}
 }
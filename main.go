@@ -2,11 +2,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"rpi-heating-system/app/config"
 	"rpi-heating-system/app/controllers"
 	"rpi-heating-system/app/services"
 	"rpi-heating-system/lib"
 	"rpi-heating-system/lib/homeassistant"
+	"strconv"
+	"strings"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -18,6 +21,8 @@ import (
 func main() {
 
 	configPath := flag.String("config", "/home/pi/config.json", "Path to the config file")
+	calibrate := flag.String("calibrate", "", "Reference temperature in °C, calibrates the sensors placed in a bath of it, writes the offsets to the config and exits")
+	calibrateSensors := flag.String("calibrate-sensors", "", "Comma separated IDs of the sensors calibrated with -calibrate, all DS18B20 sensors if empty")
 	flag.Parse()
 
 	// Load the configuration from the specified file into 'conf' struct
@@ -28,6 +33,26 @@ func main() {
 	// Set the time format for logging using zerolog package
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
+	if *calibrate != "" {
+		reference, err := strconv.ParseFloat(*calibrate, 64)
+		lib.Panic(err)
+		registry, err := services.NewTempSensorRegistry(conf, services.NewDS18B20Service(conf))
+		lib.Panic(err)
+		var ids []string
+		for _, id := range strings.Split(*calibrateSensors, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+		err = services.CalibrateSensors(registry, conf.TempSensors, ids, reference)
+		registry.Close()
+		lib.Panic(err)
+		err = ConfLoader.SaveConfigToFile(*configPath, conf)
+		lib.Panic(err)
+		log.Info().Msgf("Calibration offsets written to %s", *configPath)
+		return
+	}
+
 	// Create a new instance of the Home Assistant MQTT client
 	haMqttClient, err := homeassistant.NewHAMqttClient(conf.Mqtt)
 	lib.Panic(err)
@@ -37,7 +62,7 @@ func main() {
 	lib.Panic(err)
 
 	// Create a new instance of the heating pumps handler service
-	ps, err := services.NewHeatingPumpsHandler(c, conf.Pumps)
+	ps, err := services.NewHeatingPumpsHandler(c, conf.Pumps, conf.PumpStats)
 	lib.Panic(err)
 	defer func() {
 		err := ps.Close()
@@ -46,11 +71,41 @@ func main() {
 		}
 	}()
 
+	// Safety rules sit between all pump controllers and the GPIO pump service
+	safety, err := services.NewSafetyRulesService(ps, conf)
+	lib.Panic(err)
+	defer func() {
+		err := safety.Close()
+		if err != nil {
+			log.Error().Msgf("failed to close safety rules service: %s", err)
+		}
+	}()
+
+	safetyCtl, err := controllers.NewHASafetyHandler(haMqttClient, conf, safety)
+	lib.Panic(err)
+	haMqttClient.RegisterController(safetyCtl)
+
+	// Manual overrides take precedence over Home Assistant and local thermostats for a limited time
+	overrideSvc := services.NewOverrideService(safety, conf)
+	defer func() {
+		err := overrideSvc.Close()
+		if err != nil {
+			log.Error().Msgf("failed to close pump override service: %s", err)
+		}
+	}()
+
 	bh, err := services.NewButtonHandler(c, conf.Buttons)
 	lib.Panic(err)
+	defer func() {
+		err := bh.Close()
+		if err != nil {
+			log.Error().Msgf("failed to close button service: %s", err)
+		}
+	}()
 
 	btnSvc, err := controllers.NewHAButtonsHandler(haMqttClient, conf, bh)
 	lib.Panic(err)
+	haMqttClient.RegisterController(btnSvc)
 	defer func() {
 		err := btnSvc.Close()
 		if err != nil {
@@ -58,9 +113,24 @@ func main() {
 		}
 	}()
 
+	// Gestures are recognized from the edge timestamps of the buttons
+	gestureSvc, err := services.NewGestureService(bh, conf.Buttons)
+	lib.Panic(err)
+	defer func() {
+		err := gestureSvc.Close()
+		if err != nil {
+			log.Error().Msgf("failed to close button gesture service: %s", err)
+		}
+	}()
+
+	gestureCtl, err := controllers.NewHAButtonGesturesHandler(haMqttClient, conf, gestureSvc)
+	lib.Panic(err)
+	haMqttClient.RegisterController(gestureCtl)
+
 	// Create a new instance of the Home Assistant heating pumps handler controller
-	haPumpHandler, err := controllers.NewHAHeatingPumpsHandler(haMqttClient, conf, ps)
+	haPumpHandler, err := controllers.NewHAHeatingPumpsHandler(haMqttClient, conf, overrideSvc)
 	lib.Panic(err)
+	haMqttClient.RegisterController(haPumpHandler)
 
 	defer func() {
 		err := haPumpHandler.Close()
@@ -69,10 +139,170 @@ func main() {
 		}
 	}()
 
-	ts := services.NewDS18B20Service()
+	// Button bindings override the pumps locally, the HA pump handler reports the new states
+	bindingSvc, err := services.NewButtonBindingService(overrideSvc, gestureSvc, conf)
+	lib.Panic(err)
+	defer func() {
+		err := bindingSvc.Close()
+		if err != nil {
+			log.Error().Msgf("failed to close button binding service: %s", err)
+		}
+	}()
+
+	overrideCtl, err := controllers.NewHAPumpOverrideHandler(haMqttClient, conf, overrideSvc)
+	lib.Panic(err)
+	haMqttClient.RegisterController(overrideCtl)
+	defer func() {
+		err := overrideCtl.Close()
+		if err != nil {
+			log.Error().Msgf("failed to close home assistant pump override controller: %s", err)
+		}
+	}()
+
+	pumpStatsCtl, err := controllers.NewHAPumpStatsHandler(haMqttClient, conf, safety)
+	lib.Panic(err)
+	haMqttClient.RegisterController(pumpStatsCtl)
+	defer func() {
+		err := pumpStatsCtl.Close()
+		if err != nil {
+			log.Error().Msgf("failed to close home assistant pump stats controller: %s", err)
+		}
+	}()
+
+	ts := services.NewDS18B20Service(conf)
+
+	// Compare the 1-Wire bus with the config, so replaced probes are easy to find
+	discovery, err := ts.Discover(conf.TempSensors)
+	if err != nil {
+		log.Error().Msgf("failed to discover temperature sensors: %s", err)
+	} else {
+		for _, id := range discovery.Unconfigured {
+			log.Warn().Msgf("Found unconfigured temperature sensor %s", id)
+			if conf.AutoRegister {
+				conf.TempSensors = append(conf.TempSensors, &config.TempSensorsConfig{
+					ID:   id,
+					Name: fmt.Sprintf("Sensor %s", id),
+				})
+			}
+		}
+		for _, id := range discovery.Missing {
+			log.Warn().Msgf("Configured temperature sensor %s not found on the 1-wire bus", id)
+		}
+	}
+
+	ts.Configure(conf.TempSensors)
+
+	// Sensors other than DS18B20 are read by the driver of their type
+	registry, err := services.NewTempSensorRegistry(conf, ts)
+	lib.Panic(err)
+	defer func() {
+		err := registry.Close()
+		if err != nil {
+			log.Error().Msgf("failed to close temperature sensor drivers: %s", err)
+		}
+	}()
+
+	// All consumers read the sampler cache instead of the sensors, a stuck sensor never blocks them
+	sampler, err := services.NewTempSamplerService(services.NewCalibratedReader(registry, conf.TempSensors), conf)
+	lib.Panic(err)
+	sampler.AddTemperatureObserver(safety.OnTemperature)
+	// failed reads hold the linked safety rules active
+	sampler.AddListener(safety.OnSample)
+	sampler.Start()
+	defer func() {
+		err := sampler.Close()
+		if err != nil {
+			log.Error().Msgf("failed to close temperature sampler: %s", err)
+		}
+	}()
+
+	diagCtl, err := controllers.NewHASensorDiagnosticsHandler(haMqttClient, conf, ts)
+	lib.Panic(err)
+	haMqttClient.RegisterController(diagCtl)
+	defer func() {
+		err := diagCtl.Close()
+		if err != nil {
+			log.Error().Msgf("failed to close home assistant sensor diagnostics controller: %s", err)
+		}
+	}()
+
+	humidityCtl, err := controllers.NewHAHumidityHandler(haMqttClient, conf, registry)
+	lib.Panic(err)
+	haMqttClient.RegisterController(humidityCtl)
+	defer func() {
+		err := humidityCtl.Close()
+		if err != nil {
+			log.Error().Msgf("failed to close home assistant humidity controller: %s", err)
+		}
+	}()
+
+	// Local thermostats take over the pumps if Home Assistant stops sending commands
+	if conf.LocalCtl != nil {
+		localCtl, err := services.NewLocalControlService(overrideSvc, sampler, conf)
+		lib.Panic(err)
+		defer func() {
+			err := localCtl.Close()
+			if err != nil {
+				log.Error().Msgf("failed to close local control service: %s", err)
+			}
+		}()
+		haPumpHandler.AddCommandObserver(func(services.PumpID, services.PumpState) {
+			localCtl.NotifyHACommand()
+		})
+
+		localCtlHandler, err := controllers.NewHALocalControlHandler(haMqttClient, conf, localCtl)
+		lib.Panic(err)
+		haMqttClient.RegisterController(localCtlHandler)
+	}
+
+	if conf.BufferTank != nil {
+		tankSvc, err := services.NewBufferTankService(sampler, conf)
+		lib.Panic(err)
+
+		tankCtl, err := controllers.NewHABufferTankHandler(haMqttClient, conf, tankSvc)
+		lib.Panic(err)
+		haMqttClient.RegisterController(tankCtl)
+		defer func() {
+			err := tankCtl.Close()
+			if err != nil {
+				log.Error().Msgf("failed to close home assistant buffer tank controller: %s", err)
+			}
+		}()
+	}
+
+	if len(conf.HeatFlows) > 0 {
+		heatFlowSvc, err := services.NewHeatFlowService(sampler, safety, conf)
+		lib.Panic(err)
+
+		heatFlowCtl, err := controllers.NewHAHeatFlowHandler(haMqttClient, conf, heatFlowSvc, safety)
+		lib.Panic(err)
+		haMqttClient.RegisterController(heatFlowCtl)
+		defer func() {
+			err := heatFlowCtl.Close()
+			if err != nil {
+				log.Error().Msgf("failed to close home assistant heat flow controller: %s", err)
+			}
+		}()
+	}
+
+	if len(conf.Trends) > 0 {
+		trendSvc, err := services.NewTrendService(sampler, conf)
+		lib.Panic(err)
+
+		trendCtl, err := controllers.NewHATrendHandler(haMqttClient, conf, trendSvc)
+		lib.Panic(err)
+		haMqttClient.RegisterController(trendCtl)
+		defer func() {
+			err := trendCtl.Close()
+			if err != nil {
+				log.Error().Msgf("failed to close home assistant trend controller: %s", err)
+			}
+		}()
+	}
 
-	tempSensorsCtl, err := controllers.NewHATemperatureSensorsHandler(haMqttClient, conf, ts)
+	tempSensorsCtl, err := controllers.NewHATemperatureSensorsHandler(haMqttClient, conf, sampler)
 	lib.Panic(err)
+	haMqttClient.RegisterController(tempSensorsCtl)
 
 	defer func() {
 		err := tempSensorsCtl.Close()